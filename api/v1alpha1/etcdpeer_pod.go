@@ -0,0 +1,110 @@
+package v1alpha1
+
+// These describe the pod which the peer controller runs for an EtcdPeer. They
+// are shared with the webhook, which stops a peer's pod template from
+// clashing with them, and with the kubectl plugin, which finds the pods.
+const (
+	// AppLabel is set to AppName on the peer's pod and the resources created
+	// for it. ClusterLabel holds the name of its cluster, and PeerLabel the
+	// name of the EtcdPeer.
+	AppLabel     = "app.kubernetes.io/app"
+	AppName      = "etcd"
+	ClusterLabel = "etcd.improbable.io/cluster-name"
+	PeerLabel    = "etcd.improbable.io/peer-name"
+
+	// ClientPort and PeerPort are the ports etcd serves clients and other
+	// peers on.
+	ClientPort = 2379
+	PeerPort   = 2380
+
+	// EtcdContainerName is the name of the container running etcd.
+	EtcdContainerName = "etcd"
+
+	// DataVolumeName is the volume holding etcd's data directory, mounted
+	// at DataMountPath.
+	DataVolumeName = "etcd-data"
+	DataMountPath  = "/var/lib/etcd"
+
+	// PeerTLSVolumeName is the volume holding the certificate for traffic
+	// between peers, mounted at PeerTLSMountPath.
+	PeerTLSVolumeName = "peer-tls"
+	PeerTLSMountPath  = "/etc/etcd/tls/peer"
+
+	// ServerTLSVolumeName is the volume holding the certificate used to
+	// serve clients, mounted at ServerTLSMountPath.
+	ServerTLSVolumeName = "server-tls"
+	ServerTLSMountPath  = "/etc/etcd/tls/server"
+
+	// ClientTLSVolumeName is the volume holding the client certificate used
+	// by the health checks of the etcd container, mounted at
+	// ClientTLSMountPath.
+	ClientTLSVolumeName = "client-tls"
+	ClientTLSMountPath  = "/etc/etcd/tls/client"
+)
+
+const (
+	schemeHTTP  = "http"
+	schemeHTTPS = "https"
+)
+
+// PeerTLSSecretName returns the name of the Secret holding the certificate
+// used for traffic between peers, or an empty string if it is not encrypted.
+func (r *EtcdPeer) PeerTLSSecretName() string {
+	tls := r.Spec.TLS
+	switch {
+	case tls == nil:
+		return ""
+	case tls.PeerSecretName != "":
+		return tls.PeerSecretName
+	case tls.IssuerRef != nil:
+		return r.Name + "-peer-tls"
+	}
+	return ""
+}
+
+// ServerTLSSecretName returns the name of the Secret holding the certificate
+// used to serve clients, or an empty string if it is not encrypted.
+func (r *EtcdPeer) ServerTLSSecretName() string {
+	tls := r.Spec.TLS
+	switch {
+	case tls == nil:
+		return ""
+	case tls.ServerSecretName != "":
+		return tls.ServerSecretName
+	case tls.IssuerRef != nil:
+		return r.Name + "-server-tls"
+	}
+	return ""
+}
+
+// ClientTLSSecretName returns the name of the Secret holding the certificate
+// which the operator uses as a client of the member, or an empty string if
+// the member doesn't serve clients over TLS.
+func (r *EtcdPeer) ClientTLSSecretName() string {
+	tls := r.Spec.TLS
+	switch {
+	case r.ServerTLSSecretName() == "":
+		return ""
+	case tls.ClientSecretName != "":
+		return tls.ClientSecretName
+	case tls.IssuerRef != nil:
+		return r.Name + "-client-tls"
+	}
+	return ""
+}
+
+// PeerScheme returns the URL scheme used for traffic between peers.
+func (r *EtcdPeer) PeerScheme() string {
+	if r.PeerTLSSecretName() != "" {
+		return schemeHTTPS
+	}
+	return schemeHTTP
+}
+
+// ClientScheme returns the URL scheme used for traffic from clients.
+func (r *EtcdPeer) ClientScheme() string {
+	if r.ServerTLSSecretName() != "" {
+		return schemeHTTPS
+	}
+	return schemeHTTP
+}
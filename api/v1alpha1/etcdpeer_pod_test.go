@@ -0,0 +1,56 @@
+package v1alpha1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEtcdPeer_Schemes(t *testing.T) {
+	tests := []struct {
+		name         string
+		tls          *TLS
+		peerSecret   string
+		clientSecret string
+		peer         string
+		client       string
+	}{
+		{
+			name:   "NoTLS_HTTP",
+			peer:   "http",
+			client: "http",
+		},
+		{
+			name:       "PeerSecretOnly_PeerHTTPS",
+			tls:        &TLS{PeerSecretName: "bees-peer"},
+			peerSecret: "bees-peer",
+			peer:       "https",
+			client:     "http",
+		},
+		{
+			name:         "Issuer_BothHTTPS",
+			tls:          &TLS{IssuerRef: &IssuerReference{Name: "ca"}},
+			peerSecret:   "bees-peer-tls",
+			clientSecret: "bees-client-tls",
+			peer:         "https",
+			client:       "https",
+		},
+		{
+			name:         "ServerAndClientSecrets_ClientHTTPS",
+			tls:          &TLS{ServerSecretName: "bees-server", ClientSecretName: "operator-client"},
+			clientSecret: "operator-client",
+			peer:         "http",
+			client:       "https",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := examplePeer()
+			peer.Spec.TLS = tt.tls
+			require.Equal(t, tt.peerSecret, peer.PeerTLSSecretName())
+			require.Equal(t, tt.clientSecret, peer.ClientTLSSecretName())
+			require.Equal(t, tt.peer, peer.PeerScheme())
+			require.Equal(t, tt.client, peer.ClientScheme())
+		})
+	}
+}
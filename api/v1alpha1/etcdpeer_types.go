@@ -1,6 +1,8 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -15,9 +17,19 @@ type InitialClusterMember struct {
 	Name string `json:"name"`
 
 	// Host forms part of the Advertise URL - the URL at which this peer can
-	// be contacted. The port and scheme are hardcoded to 2380 and http
-	// respectively.
-	Host string `json:"host"`
+	// be contacted. The port is 2380, and the scheme is https when the
+	// peers use TLS and http otherwise. Hosts ending in `.svc` are
+	// qualified with the operator's cluster domain, as the peer's own
+	// advertised host is. Exactly one of `host` and `peerURLs` must be set.
+	// +optional
+	Host string `json:"host,omitempty"`
+
+	// PeerURLs are the URLs at which this peer can be contacted, for
+	// members which can't be reached at port 2380 of a host, such as those
+	// in another Kubernetes cluster behind a load balancer. When the member
+	// is the peer itself, `spec.advertise.peerURLs` must match them.
+	// +optional
+	PeerURLs []string `json:"peerURLs,omitempty"`
 }
 
 // StaticBootstrap provides static contact information for initial members of
@@ -37,6 +49,335 @@ type Bootstrap struct {
 	Static *StaticBootstrap `json:"static,omitempty"`
 }
 
+// EtcdOptions are settings passed through to the etcd process as
+// configuration. Unset fields leave the etcd default in place.
+type EtcdOptions struct {
+	// EnableV2 sets whether etcd serves the v2 API. If unset, the etcd
+	// default for the running version is used. It can only be enabled on
+	// etcd 3.3 to 3.5. Versions before 3.3 ignore the setting, and etcd 3.6
+	// removed the v2 API.
+	// +optional
+	EnableV2 *bool `json:"enableV2,omitempty"`
+
+	// QuotaBackendBytes is the size the backend database may reach before
+	// etcd raises a NOSPACE alarm and stops accepting writes. If unset, the
+	// etcd default of 2GiB is used. It should be well below the size of the
+	// peer's storage.
+	// +optional
+	QuotaBackendBytes *resource.Quantity `json:"quotaBackendBytes,omitempty"`
+
+	// HeartbeatInterval is how often the leader notifies followers that it
+	// is still the leader. It should be around the round-trip time between
+	// peers. If unset, the etcd default of 100ms is used.
+	// +optional
+	HeartbeatInterval *metav1.Duration `json:"heartbeatInterval,omitempty"`
+
+	// ElectionTimeout is how long a follower waits without hearing from the
+	// leader before starting an election. It must be at least five times
+	// the heartbeat interval, and no more than 50s. If unset, the etcd
+	// default of 1s is used.
+	// +optional
+	ElectionTimeout *metav1.Duration `json:"electionTimeout,omitempty"`
+
+	// SnapshotCount is the number of committed transactions after which etcd
+	// snapshots its raft log and discards older entries. Lowering it
+	// reduces the memory used by the log of a busy member, at the cost of
+	// followers more often needing a full snapshot to catch up. If unset,
+	// the etcd default of 100000 is used.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	SnapshotCount *int64 `json:"snapshotCount,omitempty"`
+
+	// MaxRequestBytes is the largest request that etcd will accept from a
+	// client. If unset, the etcd default of 1.5MiB is used. Raising it also
+	// raises the size of the raft messages sent between peers, so it should
+	// stay well below the backend quota.
+	// +optional
+	MaxRequestBytes *resource.Quantity `json:"maxRequestBytes,omitempty"`
+
+	// ExtraEnv are added to the environment of the etcd container, for
+	// settings which are not modelled by EtcdOptions. They may not set any
+	// of the variables managed by the operator.
+	// +optional
+	ExtraEnv []corev1.EnvVar `json:"extraEnv,omitempty"`
+
+	// ExtraArgs are passed to etcd on its command line, for example
+	// `--auto-compaction-retention=1`. They may not set any of the flags
+	// managed by the operator.
+	// +optional
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+}
+
+// AdvertiseURLs override the URLs at which a peer is reached, in place of the
+// in-cluster DNS name of its pod. The scheme of each URL must match the peer's
+// TLS configuration.
+type AdvertiseURLs struct {
+	// PeerURLs are advertised to the other peers, for example a NodePort or
+	// a load balancer reachable from another network. They should match the
+	// peer's entry in the initial cluster of every peer.
+	// +optional
+	PeerURLs []string `json:"peerURLs,omitempty"`
+
+	// ClientURLs are advertised to clients.
+	// +optional
+	ClientURLs []string `json:"clientURLs,omitempty"`
+}
+
+// NetworkPolicy describes which pods may reach the client port of a peer.
+// Only the other peers of the cluster may reach its peer port.
+type NetworkPolicy struct {
+	// ClientNamespaceSelector selects the namespaces of the pods which may
+	// connect to the client port. If only this is set, every pod in those
+	// namespaces may connect.
+	// +optional
+	ClientNamespaceSelector *metav1.LabelSelector `json:"clientNamespaceSelector,omitempty"`
+
+	// ClientPodSelector selects the pods which may connect to the client
+	// port. If `clientNamespaceSelector` is not set, these are pods in the
+	// peer's namespace. The operator must be among them for the peer's
+	// status to be reported.
+	// +optional
+	ClientPodSelector *metav1.LabelSelector `json:"clientPodSelector,omitempty"`
+
+	// PeerCIDRs are the address ranges from which members outside this
+	// Kubernetes cluster connect to the peer port, for clusters stretched
+	// across several Kubernetes clusters.
+	// +optional
+	PeerCIDRs []string `json:"peerCIDRs,omitempty"`
+}
+
+// Membership controls how the operator manages the members of the peer's etcd
+// cluster.
+type Membership struct {
+	// RemoveStaleMembers has the operator remove members of the cluster
+	// which belong to no EtcdPeer, once they have been stale for
+	// `staleMemberGracePeriod`. A voting member is only removed while the
+	// cluster keeps its quorum without it. Learners don't vote, so they are
+	// removed as soon as they are found. If unset, the operator's
+	// `removeStaleMembers` setting is used. The setting of the peer whose
+	// member is the leader applies, so it should be the same on every peer
+	// of the cluster.
+	// +optional
+	RemoveStaleMembers *bool `json:"removeStaleMembers,omitempty"`
+
+	// StaleMemberGracePeriod is how long a member must be seen to be stale
+	// before it is removed. If unset, the operator's
+	// `staleMemberGracePeriod` is used.
+	// +optional
+	StaleMemberGracePeriod *metav1.Duration `json:"staleMemberGracePeriod,omitempty"`
+}
+
+// IPFamily is a version of the Internet Protocol.
+type IPFamily string
+
+const (
+	// IPv4Family is IPv4.
+	IPv4Family IPFamily = "IPv4"
+	// IPv6Family is IPv6.
+	IPv6Family IPFamily = "IPv6"
+)
+
+// IssuerReference names a cert-manager issuer.
+type IssuerReference struct {
+	// Name of the issuer.
+	Name string `json:"name"`
+
+	// Kind of the issuer, either `Issuer` in the namespace of the peer or
+	// `ClusterIssuer`. Defaults to `Issuer`.
+	// +kubebuilder:validation:Enum=Issuer;ClusterIssuer
+	// +optional
+	Kind string `json:"kind,omitempty"`
+}
+
+// TLS names the Secrets holding the certificates used to encrypt etcd
+// traffic. Each Secret must contain `tls.crt` and `tls.key` for this peer,
+// and `ca.crt` which is used to verify the other end of the connection.
+type TLS struct {
+	// PeerSecretName is the Secret used for traffic between peers. When set,
+	// the peer URLs use https and other peers must present a certificate
+	// signed by the CA.
+	// +optional
+	PeerSecretName string `json:"peerSecretName,omitempty"`
+
+	// ServerSecretName is the Secret used to serve clients. When set, the
+	// client URLs use https and clients must present a certificate signed by
+	// the CA. The certificate must be valid for `localhost`, which the
+	// health checks of the etcd container connect to.
+	// +optional
+	ServerSecretName string `json:"serverSecretName,omitempty"`
+
+	// ClientSecretName is the Secret holding the client certificate which
+	// the operator, and the health checks of the etcd container, present to
+	// the member when it serves clients over TLS. The certificate must be
+	// valid for client authentication. It is required when the server
+	// certificate is not issued by `issuerRef`.
+	// +optional
+	ClientSecretName string `json:"clientSecretName,omitempty"`
+
+	// IssuerRef is a cert-manager issuer used to issue the peer, server and
+	// operator client certificates. The operator creates a `Certificate` for
+	// each, stored in the Secrets named above or, if they are not set, in
+	// `<peer name>-peer-tls`, `<peer name>-server-tls` and
+	// `<peer name>-client-tls`. The pod is not started until all of the
+	// Secrets have been issued.
+	// +optional
+	IssuerRef *IssuerReference `json:"issuerRef,omitempty"`
+}
+
+// Image configures where the etcd image is pulled from.
+type Image struct {
+	// Repository replaces the repository of the etcd image, for example with
+	// a mirror in a private registry. The tag is still chosen by the
+	// operator.
+	// +optional
+	Repository string `json:"repository,omitempty"`
+
+	// PullPolicy is the pull policy of the etcd image.
+	// +kubebuilder:validation:Enum=Always;Never;IfNotPresent
+	// +optional
+	PullPolicy corev1.PullPolicy `json:"pullPolicy,omitempty"`
+
+	// PullSecrets are Secrets in the peer's namespace used to pull the etcd
+	// image.
+	// +optional
+	PullSecrets []corev1.LocalObjectReference `json:"pullSecrets,omitempty"`
+}
+
+// EtcdPodTemplateSpec supports a subset of a normal `v1/PodTemplateSpec`
+// that the operator explicitly permits. We don't want to allow a user to set
+// arbitrary features on our pods.
+type EtcdPodTemplateSpec struct {
+	// LivenessProbe adjusts the timing of the liveness probe of the etcd
+	// container, which checks the member's health endpoint. A member which
+	// has been without a leader for longer than the probe allows is
+	// restarted.
+	// +optional
+	LivenessProbe *ProbeThresholds `json:"livenessProbe,omitempty"`
+
+	// ReadinessProbe adjusts the timing of the readiness probe of the etcd
+	// container. The probe makes a linearized read, so the pod is only ready
+	// once the member has caught up with a quorate cluster. Services used
+	// by peers to find each other should publish not-ready addresses.
+	// +optional
+	ReadinessProbe *ProbeThresholds `json:"readinessProbe,omitempty"`
+
+	// Affinity replaces the scheduling constraints of the pod. By default
+	// the pod prefers not to share a node with other peers of the same
+	// cluster, so that losing a node can't take down quorum.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+
+	// NodeSelector must match a node's labels for the pod to be scheduled
+	// on that node.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Tolerations allow the pod to be scheduled on nodes with matching
+	// taints, such as nodes dedicated to etcd.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// PriorityClassName is the name of the PriorityClass of the pod. etcd
+	// usually deserves a higher priority than the workloads relying on it.
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// HostNetwork runs the pod in the host's network namespace, to avoid
+	// the latency of the pod network. The peer then advertises the IP
+	// address of its node, unless its advertise URLs are overridden, and
+	// only one peer can run on each node. Certificates issued through
+	// `tls.issuerRef` don't cover the node's address.
+	// +optional
+	HostNetwork bool `json:"hostNetwork,omitempty"`
+
+	// ServiceAccountName is the name of the ServiceAccount the pod runs as,
+	// for example one which is granted access to a backup bucket.
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// SchedulerName is the name of the scheduler which places the pod. If
+	// not set the default scheduler is used.
+	// +optional
+	SchedulerName string `json:"schedulerName,omitempty"`
+
+	// RuntimeClassName is the name of the RuntimeClass used to run the pod,
+	// such as a sandboxed runtime.
+	// +optional
+	RuntimeClassName *string `json:"runtimeClassName,omitempty"`
+
+	// SecurityContext holds the pod-level security attributes. Set
+	// `fsGroup` when running etcd as a non-root user so that it can write to
+	// its data directory.
+	// +optional
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
+
+	// ContainerSecurityContext holds the security options of the etcd
+	// container.
+	// +optional
+	ContainerSecurityContext *corev1.SecurityContext `json:"containerSecurityContext,omitempty"`
+
+	// Resources are the compute resources of the etcd container. etcd
+	// should be given enough memory to hold its whole database, and a
+	// guaranteed share of CPU so that it keeps up with its heartbeats.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Volumes are added to the pod alongside the volumes managed by the
+	// operator, whose names may not be used.
+	// +optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+
+	// VolumeMounts are added to the etcd container. They may not use the
+	// mount paths of the volumes managed by the operator.
+	// +optional
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+
+	// InitContainers are run before the etcd container is started, for
+	// example to prepare the data directory.
+	// +optional
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+
+	// AdditionalContainers are run in the pod alongside the etcd container,
+	// for example to export metrics or ship logs. They may not be named
+	// `etcd`.
+	// +optional
+	AdditionalContainers []corev1.Container `json:"additionalContainers,omitempty"`
+}
+
+// ProbeThresholds overrides the timing of one of the probes defined by the
+// operator. Fields which are not set keep the operator's defaults.
+type ProbeThresholds struct {
+	// InitialDelaySeconds is the number of seconds after the container
+	// has started before the probe is first run.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	InitialDelaySeconds *int32 `json:"initialDelaySeconds,omitempty"`
+
+	// TimeoutSeconds is the number of seconds after which the probe times
+	// out.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+
+	// PeriodSeconds is how often, in seconds, to run the probe.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	PeriodSeconds *int32 `json:"periodSeconds,omitempty"`
+
+	// SuccessThreshold is the number of consecutive successes for the probe
+	// to be considered successful after having failed. Must be 1 for the
+	// liveness probe.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	SuccessThreshold *int32 `json:"successThreshold,omitempty"`
+
+	// FailureThreshold is the number of consecutive failures for the probe
+	// to be considered failed after having succeeded.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	FailureThreshold *int32 `json:"failureThreshold,omitempty"`
+}
+
 // EtcdPeerSpec defines the desired state of EtcdPeer
 type EtcdPeerSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
@@ -53,15 +394,126 @@ type EtcdPeerSpec struct {
 	// instructions if it already knows where it's peers are.
 	// +optional
 	Bootstrap *Bootstrap `json:"bootstrap,omitempty"`
+
+	// Etcd holds settings for the etcd process itself.
+	// +optional
+	Etcd *EtcdOptions `json:"etcd,omitempty"`
+
+	// Advertise overrides the URLs that this peer advertises to other peers
+	// and to clients, for peers which must be reached from outside the
+	// Kubernetes cluster.
+	// +optional
+	Advertise *AdvertiseURLs `json:"advertise,omitempty"`
+
+	// NetworkPolicy has the operator create a NetworkPolicy for the peer,
+	// restricting who may connect to it. If unset, no policy is created.
+	// +optional
+	NetworkPolicy *NetworkPolicy `json:"networkPolicy,omitempty"`
+
+	// IPFamily is the IP family that etcd listens on. Set it to `IPv6` on
+	// clusters whose pods only have IPv6 addresses. Defaults to `IPv4`.
+	// +kubebuilder:validation:Enum=IPv4;IPv6
+	// +optional
+	IPFamily IPFamily `json:"ipFamily,omitempty"`
+
+	// Membership controls how the operator manages the members of the
+	// peer's cluster.
+	// +optional
+	Membership *Membership `json:"membership,omitempty"`
+
+	// TLS enables encryption of peer and client traffic. Every peer of a
+	// cluster should use the same TLS configuration.
+	// +optional
+	TLS *TLS `json:"tls,omitempty"`
+
+	// Image configures where the etcd image is pulled from.
+	// +optional
+	Image *Image `json:"image,omitempty"`
+
+	// PodTemplate describes settings for the pod that runs etcd.
+	// +optional
+	PodTemplate *EtcdPodTemplateSpec `json:"podTemplate,omitempty"`
+}
+
+// EtcdPeerDefaults are the settings applied by the defaulting webhook to new
+// EtcdPeers which don't set them, so that minimal manifests still produce
+// well configured peers. Each field of the pod template and etcd options is
+// defaulted on its own, except for volumes and containers.
+type EtcdPeerDefaults struct {
+	// Etcd holds defaults for the etcd options of new peers.
+	// +optional
+	Etcd *EtcdOptions `json:"etcd,omitempty"`
+
+	// PodTemplate holds defaults for the pod template of new peers.
+	// +optional
+	PodTemplate *EtcdPodTemplateSpec `json:"podTemplate,omitempty"`
+}
+
+// PausedAnnotation, set to "true" on an EtcdPeer, stops the operator changing
+// any of the peer's resources. Its status is still updated. This allows
+// manual repairs without the operator reverting them.
+const PausedAnnotation = "etcd.improbable.io/paused"
+
+// EtcdPeerConditionType is the type of an EtcdPeerCondition.
+type EtcdPeerConditionType string
+
+const (
+	// EtcdPeerReady means that the peer's pod is ready and that the etcd
+	// member reports itself as healthy.
+	EtcdPeerReady EtcdPeerConditionType = "Ready"
+)
+
+// EtcdPeerCondition describes the state of an EtcdPeer at a certain point.
+type EtcdPeerCondition struct {
+	// Type of the condition.
+	Type EtcdPeerConditionType `json:"type"`
+
+	// Status of the condition, one of True, False or Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime is the last time the condition changed status.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Reason is a CamelCase reason for the condition's last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human readable message with details about the last
+	// transition.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // EtcdPeerStatus defines the observed state of EtcdPeer
 type EtcdPeerStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// MemberID is the etcd member ID of the peer, in the hexadecimal form
+	// used by etcdctl.
+	// +optional
+	MemberID string `json:"memberID,omitempty"`
+
+	// Version is the version of etcd that the peer is running.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// DBSize is the size of the peer's backend database.
+	// +optional
+	DBSize *resource.Quantity `json:"dbSize,omitempty"`
+
+	// Conditions describe the current state of the peer.
+	// +optional
+	Conditions []EtcdPeerCondition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=etcdp
+// +kubebuilder:printcolumn:name="Cluster",type="string",JSONPath=".spec.clusterName"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".status.version"
+// +kubebuilder:printcolumn:name="Member ID",type="string",JSONPath=".status.memberID",priority=1
+// +kubebuilder:printcolumn:name="DB Size",type="string",JSONPath=".status.dbSize",priority=1
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // EtcdPeer is the Schema for the etcdpeers API
 type EtcdPeer struct {
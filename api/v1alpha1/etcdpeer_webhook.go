@@ -0,0 +1,553 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// These are the volumes of the etcd pod which are managed by the operator,
+// and where they are mounted in the etcd container.
+var (
+	reservedVolumeNames = sets.NewString(DataVolumeName, PeerTLSVolumeName, ServerTLSVolumeName, ClientTLSVolumeName)
+	reservedMountPaths  = sets.NewString(DataMountPath, PeerTLSMountPath, ServerTLSMountPath, ClientTLSMountPath)
+)
+
+// managedEtcdFlags are the etcd flags which the peer controller sets, either
+// always or from EtcdOptions. They can't be overridden with ExtraArgs, or
+// through their environment variables with ExtraEnv.
+var managedEtcdFlags = sets.NewString(
+	"name",
+	"data-dir",
+	"initial-cluster",
+	"initial-advertise-peer-urls",
+	"listen-peer-urls",
+	"advertise-client-urls",
+	"listen-client-urls",
+	"cert-file",
+	"key-file",
+	"trusted-ca-file",
+	"client-cert-auth",
+	"peer-cert-file",
+	"peer-key-file",
+	"peer-trusted-ca-file",
+	"peer-client-cert-auth",
+	"enable-v2",
+	"quota-backend-bytes",
+	"heartbeat-interval",
+	"election-timeout",
+	"snapshot-count",
+	"max-request-bytes",
+)
+
+var managedEtcdEnvVars = func() sets.String {
+	envVars := sets.NewString()
+	for _, flag := range managedEtcdFlags.List() {
+		envVars.Insert(etcdEnvVarName(flag))
+	}
+	return envVars
+}()
+
+// log is for logging in this package.
+var etcdpeerlog = logf.Log.WithName("etcdpeer-resource")
+
+const (
+	recreateMessage = "may not be changed once the peer has been created, delete and recreate the EtcdPeer instead"
+	reservedMessage = "is used by the operator"
+	managedMessage  = "is managed by the operator"
+
+	// These match the etcd defaults and limits for its raft timing.
+	defaultHeartbeatInterval = 100 * time.Millisecond
+	defaultElectionTimeout   = time.Second
+	maxElectionTimeout       = 50 * time.Second
+)
+
+func (r *EtcdPeer) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// peerDefaults are applied to new EtcdPeers by the defaulting webhook.
+var peerDefaults EtcdPeerDefaults
+
+// SetPeerDefaults sets the defaults applied to new EtcdPeers by the defaulting
+// webhook. It must be called before the webhook is served.
+func SetPeerDefaults(defaults EtcdPeerDefaults) {
+	peerDefaults = *defaults.DeepCopy()
+}
+
+// ValidatePeerDefaults checks that a peer given nothing but `defaults` would
+// be accepted by the validating webhook when run with `image`, so that bad
+// defaults are found when the operator starts rather than when a peer is
+// created. The errors are reported under `fldPath` rather than `spec`.
+func ValidatePeerDefaults(fldPath *field.Path, defaults EtcdPeerDefaults, image string) field.ErrorList {
+	peer := &EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "defaults"},
+		Spec: EtcdPeerSpec{
+			Bootstrap: &Bootstrap{
+				Static: &StaticBootstrap{
+					InitialCluster: []InitialClusterMember{{Name: "defaults", Host: "defaults"}},
+				},
+			},
+		},
+	}
+	peer.applyDefaults(defaults)
+	allErrs := peer.validateSpec(image)
+	specPath := field.NewPath("spec").String()
+	for _, err := range allErrs {
+		err.Field = fldPath.String() + strings.TrimPrefix(err.Field, specPath)
+	}
+	return allErrs
+}
+
+// etcdImage is the image the operator runs etcd with, which the validating
+// webhook checks version specific fields against.
+var etcdImage string
+
+// SetEtcdImage sets the image the operator runs etcd with. It must be called
+// before the webhook is served.
+func SetEtcdImage(image string) {
+	etcdImage = image
+}
+
+// +kubebuilder:webhook:path=/mutate-etcd-improbable-io-v1alpha1-etcdpeer,mutating=true,failurePolicy=fail,groups=etcd.improbable.io,resources=etcdpeers,verbs=create,versions=v1alpha1,name=metcdpeer.kb.io
+
+var _ webhook.Defaulter = &EtcdPeer{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *EtcdPeer) Default() {
+	etcdpeerlog.V(2).Info("default", "name", r.Name)
+	r.applyDefaults(peerDefaults)
+}
+
+// applyDefaults sets each field of the peer which is unset and has a value in
+// `defaults`.
+func (r *EtcdPeer) applyDefaults(defaults EtcdPeerDefaults) {
+	// Copy the defaults so that peers don't share any pointers with them.
+	defaults = *defaults.DeepCopy()
+
+	if d := defaults.Etcd; d != nil {
+		if r.Spec.Etcd == nil {
+			r.Spec.Etcd = &EtcdOptions{}
+		}
+		options := r.Spec.Etcd
+		if options.EnableV2 == nil {
+			options.EnableV2 = d.EnableV2
+		}
+		if options.QuotaBackendBytes == nil {
+			options.QuotaBackendBytes = d.QuotaBackendBytes
+		}
+		if options.HeartbeatInterval == nil {
+			options.HeartbeatInterval = d.HeartbeatInterval
+		}
+		if options.ElectionTimeout == nil {
+			options.ElectionTimeout = d.ElectionTimeout
+		}
+		if options.SnapshotCount == nil {
+			options.SnapshotCount = d.SnapshotCount
+		}
+		if options.MaxRequestBytes == nil {
+			options.MaxRequestBytes = d.MaxRequestBytes
+		}
+	}
+
+	if d := defaults.PodTemplate; d != nil {
+		if r.Spec.PodTemplate == nil {
+			r.Spec.PodTemplate = &EtcdPodTemplateSpec{}
+		}
+		template := r.Spec.PodTemplate
+		if template.LivenessProbe == nil {
+			template.LivenessProbe = d.LivenessProbe
+		}
+		if template.ReadinessProbe == nil {
+			template.ReadinessProbe = d.ReadinessProbe
+		}
+		if template.Affinity == nil {
+			template.Affinity = d.Affinity
+		}
+		if template.NodeSelector == nil {
+			template.NodeSelector = d.NodeSelector
+		}
+		if template.Tolerations == nil {
+			template.Tolerations = d.Tolerations
+		}
+		if template.PriorityClassName == "" {
+			template.PriorityClassName = d.PriorityClassName
+		}
+		if template.ServiceAccountName == "" {
+			template.ServiceAccountName = d.ServiceAccountName
+		}
+		if template.SchedulerName == "" {
+			template.SchedulerName = d.SchedulerName
+		}
+		if template.RuntimeClassName == nil {
+			template.RuntimeClassName = d.RuntimeClassName
+		}
+		if template.SecurityContext == nil {
+			template.SecurityContext = d.SecurityContext
+		}
+		if template.ContainerSecurityContext == nil {
+			template.ContainerSecurityContext = d.ContainerSecurityContext
+		}
+		if template.Resources == nil {
+			template.Resources = d.Resources
+		}
+	}
+}
+
+// +kubebuilder:webhook:path=/validate-etcd-improbable-io-v1alpha1-etcdpeer,mutating=false,failurePolicy=fail,groups=etcd.improbable.io,resources=etcdpeers,verbs=create;update,versions=v1alpha1,name=vetcdpeer.kb.io
+
+var _ webhook.Validator = &EtcdPeer{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *EtcdPeer) ValidateCreate() error {
+	etcdpeerlog.V(2).Info("validate create", "name", r.Name)
+	if allErrs := r.validateSpec(etcdImage); len(allErrs) > 0 {
+		return apierrs.NewInvalid(GroupVersion.WithKind("EtcdPeer").GroupKind(), r.Name, allErrs)
+	}
+	return nil
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *EtcdPeer) ValidateUpdate(old runtime.Object) error {
+	etcdpeerlog.V(2).Info("validate update", "name", r.Name)
+	oldPeer, ok := old.(*EtcdPeer)
+	if !ok {
+		return apierrs.NewBadRequest("old object is not an EtcdPeer")
+	}
+	allErrs := r.validateSpec(etcdImage)
+	allErrs = append(allErrs, r.ValidateImmutableFields(oldPeer)...)
+	if len(allErrs) > 0 {
+		return apierrs.NewInvalid(GroupVersion.WithKind("EtcdPeer").GroupKind(), r.Name, allErrs)
+	}
+	return nil
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *EtcdPeer) ValidateDelete() error {
+	etcdpeerlog.V(2).Info("validate delete", "name", r.Name)
+	return nil
+}
+
+// validateSpec checks the settings of the peer which the CRD schema can't,
+// for a peer run with `image`.
+func (r *EtcdPeer) validateSpec(image string) field.ErrorList {
+	allErrs := r.validatePodTemplate()
+	allErrs = append(allErrs, r.validateAdvertiseURLs()...)
+	allErrs = append(allErrs, r.validateInitialCluster()...)
+	allErrs = append(allErrs, r.validateNetworkPolicy()...)
+	allErrs = append(allErrs, r.validateTLS()...)
+	if membership := r.Spec.Membership; membership != nil && membership.StaleMemberGracePeriod != nil {
+		if gracePeriod := membership.StaleMemberGracePeriod.Duration; gracePeriod <= 0 {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "membership", "staleMemberGracePeriod"),
+				gracePeriod.String(), "must be greater than zero"))
+		}
+	}
+	if r.Spec.Etcd == nil {
+		return allErrs
+	}
+	etcdPath := field.NewPath("spec", "etcd")
+
+	if enableV2 := r.Spec.Etcd.EnableV2; enableV2 != nil {
+		allErrs = append(allErrs, validateEnableV2(etcdPath.Child("enableV2"), *enableV2, image)...)
+	}
+	if quota := r.Spec.Etcd.QuotaBackendBytes; quota != nil && quota.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(etcdPath.Child("quotaBackendBytes"), quota.String(), "must be greater than zero"))
+	}
+	if count := r.Spec.Etcd.SnapshotCount; count != nil && *count <= 0 {
+		allErrs = append(allErrs, field.Invalid(etcdPath.Child("snapshotCount"), *count, "must be greater than zero"))
+	}
+	if max := r.Spec.Etcd.MaxRequestBytes; max != nil && max.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(etcdPath.Child("maxRequestBytes"), max.String(), "must be greater than zero"))
+	}
+
+	heartbeat := defaultHeartbeatInterval
+	if r.Spec.Etcd.HeartbeatInterval != nil {
+		heartbeat = r.Spec.Etcd.HeartbeatInterval.Duration
+		if heartbeat < time.Millisecond {
+			allErrs = append(allErrs, field.Invalid(etcdPath.Child("heartbeatInterval"), heartbeat.String(), "must be at least 1ms"))
+		}
+	}
+	election := defaultElectionTimeout
+	if r.Spec.Etcd.ElectionTimeout != nil {
+		election = r.Spec.Etcd.ElectionTimeout.Duration
+		if election > maxElectionTimeout {
+			allErrs = append(allErrs, field.Invalid(etcdPath.Child("electionTimeout"), election.String(),
+				fmt.Sprintf("must be no more than %s", maxElectionTimeout)))
+		}
+	}
+	if election < 5*heartbeat {
+		allErrs = append(allErrs, field.Invalid(etcdPath.Child("electionTimeout"), election.String(),
+			fmt.Sprintf("must be at least five times the heartbeat interval of %s", heartbeat)))
+	}
+
+	for i, env := range r.Spec.Etcd.ExtraEnv {
+		if managedEtcdEnvVars.Has(env.Name) {
+			allErrs = append(allErrs, field.Invalid(etcdPath.Child("extraEnv").Index(i).Child("name"), env.Name, managedMessage))
+		}
+	}
+	for i, arg := range r.Spec.Etcd.ExtraArgs {
+		if managedEtcdFlags.Has(etcdFlagName(arg)) {
+			allErrs = append(allErrs, field.Invalid(etcdPath.Child("extraArgs").Index(i), arg, managedMessage))
+		}
+	}
+
+	return allErrs
+}
+
+// validateEnableV2 checks that the version of etcd run by `image` lets the v2
+// API be set as asked. Only etcd 3.3 to 3.5 can turn it on. Older versions
+// don't know the setting and ignore it, so turning it off is accepted there,
+// which lets a default meant for newer versions be given to every peer. Images
+// whose version can't be told from their tag are allowed.
+func validateEnableV2(fldPath *field.Path, enableV2 bool, image string) field.ErrorList {
+	var allErrs field.ErrorList
+	major, minor, ok := etcdImageVersion(image)
+	if !ok {
+		return allErrs
+	}
+	switch {
+	case enableV2 && (major < 3 || major == 3 && minor < 3):
+		allErrs = append(allErrs, field.Invalid(fldPath, enableV2,
+			fmt.Sprintf("enabling the v2 API requires etcd 3.3 or later, the operator runs %s", image)))
+	case enableV2 && (major > 3 || major == 3 && minor >= 6):
+		allErrs = append(allErrs, field.Invalid(fldPath, enableV2,
+			fmt.Sprintf("etcd 3.6 removed the v2 API, the operator runs %s", image)))
+	}
+	return allErrs
+}
+
+// etcdImageVersion returns the major and minor version of etcd from the tag of
+// `image`, such as `quay.io/coreos/etcd:v3.2.27`.
+func etcdImageVersion(image string) (major, minor int, ok bool) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(image[i+1:], "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// validateAdvertiseURLs checks that any advertised URLs can be dialled with
+// the scheme that the peer serves.
+func (r *EtcdPeer) validateAdvertiseURLs() field.ErrorList {
+	var allErrs field.ErrorList
+	advertise := r.Spec.Advertise
+	if advertise == nil {
+		return allErrs
+	}
+	advertisePath := field.NewPath("spec", "advertise")
+	allErrs = append(allErrs, validateURLs(advertisePath.Child("peerURLs"), advertise.PeerURLs, r.PeerScheme())...)
+	allErrs = append(allErrs, validateURLs(advertisePath.Child("clientURLs"), advertise.ClientURLs, r.ClientScheme())...)
+	return allErrs
+}
+
+// validateInitialCluster checks that the peer has a static initial cluster, and
+// that each initial member has either a host or peer URLs. A peer which lists
+// its own peer URLs must also advertise them, or etcd refuses to start.
+func (r *EtcdPeer) validateInitialCluster() field.ErrorList {
+	var allErrs field.ErrorList
+	if r.Spec.Bootstrap == nil || r.Spec.Bootstrap.Static == nil {
+		allErrs = append(allErrs, field.Required(field.NewPath("spec", "bootstrap", "static"),
+			"the peer must be bootstrapped with a static initial cluster"))
+		return allErrs
+	}
+	members := r.Spec.Bootstrap.Static.InitialCluster
+	clusterPath := field.NewPath("spec", "bootstrap", "static", "initialCluster")
+	peerScheme := r.PeerScheme()
+
+	for i, member := range members {
+		memberPath := clusterPath.Index(i)
+		switch {
+		case member.Host == "" && len(member.PeerURLs) == 0:
+			allErrs = append(allErrs, field.Required(memberPath, "one of host and peerURLs must be set"))
+		case member.Host != "" && len(member.PeerURLs) > 0:
+			allErrs = append(allErrs, field.Invalid(memberPath.Child("peerURLs"), member.PeerURLs, "must not be set with host"))
+		}
+		allErrs = append(allErrs, validateURLs(memberPath.Child("peerURLs"), member.PeerURLs, peerScheme)...)
+
+		if member.Name != r.Name || len(member.PeerURLs) == 0 {
+			continue
+		}
+		var advertised []string
+		if r.Spec.Advertise != nil {
+			advertised = r.Spec.Advertise.PeerURLs
+		}
+		if !reflect.DeepEqual(advertised, member.PeerURLs) {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "advertise", "peerURLs"), advertised,
+				fmt.Sprintf("must match the peerURLs of %s in the initial cluster", r.Name)))
+		}
+	}
+	return allErrs
+}
+
+// validateTLS checks that the operator has a client certificate for members
+// which serve clients over TLS. The server certificate can't be used in its
+// place, as it may not be valid for client authentication.
+func (r *EtcdPeer) validateTLS() field.ErrorList {
+	var allErrs field.ErrorList
+	tls := r.Spec.TLS
+	if tls == nil || tls.ClientSecretName != "" {
+		return allErrs
+	}
+	if r.ServerTLSSecretName() != "" && r.ClientTLSSecretName() == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("spec", "tls", "clientSecretName"),
+			"must be set when serverSecretName is set without issuerRef"))
+	}
+	return allErrs
+}
+
+// validateNetworkPolicy checks the address ranges of external peers.
+func (r *EtcdPeer) validateNetworkPolicy() field.ErrorList {
+	var allErrs field.ErrorList
+	if r.Spec.NetworkPolicy == nil {
+		return allErrs
+	}
+	cidrsPath := field.NewPath("spec", "networkPolicy", "peerCIDRs")
+	for i, cidr := range r.Spec.NetworkPolicy.PeerCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(cidrsPath.Index(i), cidr, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// validateURLs checks that each of `urls` is the base URL of a host using
+// `scheme`.
+func validateURLs(fldPath *field.Path, urls []string, scheme string) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, raw := range urls {
+		u, err := url.Parse(raw)
+		switch {
+		case err != nil:
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), raw, err.Error()))
+		case u.Scheme != scheme:
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), raw, fmt.Sprintf("must use %s", scheme)))
+		case u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil:
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), raw, "must only have a scheme, host and port"))
+		}
+	}
+	return allErrs
+}
+
+// etcdFlagName returns the name of the flag given by a command line argument
+// such as `--name=value`, or an empty string if it isn't a flag.
+func etcdFlagName(arg string) string {
+	if !strings.HasPrefix(arg, "-") {
+		return ""
+	}
+	name := strings.TrimLeft(arg, "-")
+	if i := strings.Index(name, "="); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// etcdEnvVarName returns the environment variable which etcd reads for a flag.
+func etcdEnvVarName(flag string) string {
+	return "ETCD_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// validatePodTemplate checks that the pod template doesn't conflict with the
+// parts of the pod which are managed by the operator.
+func (r *EtcdPeer) validatePodTemplate() field.ErrorList {
+	var allErrs field.ErrorList
+	template := r.Spec.PodTemplate
+	if template == nil {
+		return allErrs
+	}
+	templatePath := field.NewPath("spec", "podTemplate")
+
+	if template.LivenessProbe != nil {
+		if threshold := template.LivenessProbe.SuccessThreshold; threshold != nil && *threshold != 1 {
+			allErrs = append(allErrs, field.Invalid(
+				templatePath.Child("livenessProbe", "successThreshold"), *threshold, "must be 1"))
+		}
+	}
+
+	for i, volume := range template.Volumes {
+		if reservedVolumeNames.Has(volume.Name) {
+			allErrs = append(allErrs, field.Invalid(
+				templatePath.Child("volumes").Index(i).Child("name"), volume.Name, reservedMessage))
+		}
+	}
+	for i, mount := range template.VolumeMounts {
+		if reservedVolumeNames.Has(mount.Name) {
+			allErrs = append(allErrs, field.Invalid(
+				templatePath.Child("volumeMounts").Index(i).Child("name"), mount.Name, reservedMessage))
+		}
+		if reservedMountPaths.Has(path.Clean(mount.MountPath)) {
+			allErrs = append(allErrs, field.Invalid(
+				templatePath.Child("volumeMounts").Index(i).Child("mountPath"), mount.MountPath, reservedMessage))
+		}
+	}
+
+	for i, container := range template.AdditionalContainers {
+		if container.Name == EtcdContainerName {
+			allErrs = append(allErrs, field.Invalid(
+				templatePath.Child("additionalContainers").Index(i).Child("name"), container.Name, reservedMessage))
+		}
+	}
+
+	return allErrs
+}
+
+// ValidateImmutableFields checks that none of the fields which tie the peer to
+// its running pod and data have been changed since `old`. The advertise URLs,
+// subdomain and persisted member data all derive from these, so changing them
+// in place would leave the peer in a state that belongs to neither cluster.
+func (r *EtcdPeer) ValidateImmutableFields(old *EtcdPeer) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if r.Spec.ClusterName != old.Spec.ClusterName {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("clusterName"), recreateMessage))
+	}
+
+	if !reflect.DeepEqual(staticInitialCluster(r.Spec.Bootstrap), staticInitialCluster(old.Spec.Bootstrap)) {
+		allErrs = append(allErrs, field.Forbidden(
+			specPath.Child("bootstrap", "static", "initialCluster"),
+			recreateMessage,
+		))
+	}
+
+	return allErrs
+}
+
+// staticInitialCluster returns the static initial cluster of the bootstrap
+// configuration, or nil if there isn't one.
+func staticInitialCluster(bootstrap *Bootstrap) []InitialClusterMember {
+	if bootstrap == nil || bootstrap.Static == nil {
+		return nil
+	}
+	return bootstrap.Static.InitialCluster
+}
@@ -0,0 +1,566 @@
+package v1alpha1
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func examplePeer() *EtcdPeer {
+	return &EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "bees",
+			Namespace:   "default",
+			Annotations: map[string]string{},
+		},
+		Spec: EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &Bootstrap{
+				Static: &StaticBootstrap{
+					InitialCluster: []InitialClusterMember{
+						{
+							Name: "bees",
+							Host: "bees.my-cluster.default.svc",
+						},
+						{
+							Name: "magic",
+							Host: "magic.my-cluster.default.svc",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestEtcdPeer_ValidateUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(peer *EtcdPeer)
+		wantErr bool
+	}{
+		{
+			name:   "Unchanged_Allowed",
+			modify: func(peer *EtcdPeer) {},
+		},
+		{
+			name: "ChangedAnnotations_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Annotations["example.com/foo"] = "bar"
+			},
+		},
+		{
+			name: "ChangedClusterName_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.ClusterName = "other-cluster"
+			},
+			wantErr: true,
+		},
+		{
+			name: "ChangedInitialClusterHost_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap.Static.InitialCluster[1].Host = "magic.other-cluster.default.svc"
+			},
+			wantErr: true,
+		},
+		{
+			name: "AddedInitialClusterMember_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap.Static.InitialCluster = append(
+					peer.Spec.Bootstrap.Static.InitialCluster,
+					InitialClusterMember{Name: "third", Host: "third.my-cluster.default.svc"},
+				)
+			},
+			wantErr: true,
+		},
+		{
+			name: "RemovedBootstrap_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap = nil
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := examplePeer()
+			updated := old.DeepCopy()
+			tt.modify(updated)
+
+			err := updated.ValidateUpdate(old)
+			if tt.wantErr {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "delete and recreate the EtcdPeer")
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestEtcdPeer_ValidateCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(peer *EtcdPeer)
+		wantErr bool
+	}{
+		{
+			name:   "Minimal_Allowed",
+			modify: func(peer *EtcdPeer) {},
+		},
+		{
+			name: "WithoutBootstrap_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap = nil
+			},
+			wantErr: true,
+		},
+		{
+			name: "WithoutStaticBootstrap_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap = &Bootstrap{}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ServerSecretWithoutClientSecret_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.TLS = &TLS{ServerSecretName: "bees-server-tls"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ServerAndClientSecrets_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.TLS = &TLS{ServerSecretName: "bees-server-tls", ClientSecretName: "operator-client-tls"}
+			},
+		},
+		{
+			name: "ServerSecretWithIssuer_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.TLS = &TLS{ServerSecretName: "bees-server-tls", IssuerRef: &IssuerReference{Name: "etcd-ca"}}
+			},
+		},
+		{
+			name: "QuotaBackendBytes_Allowed",
+			modify: func(peer *EtcdPeer) {
+				quota := resource.MustParse("4Gi")
+				peer.Spec.Etcd = &EtcdOptions{QuotaBackendBytes: &quota}
+			},
+		},
+		{
+			name: "NegativeQuotaBackendBytes_Rejected",
+			modify: func(peer *EtcdPeer) {
+				quota := resource.MustParse("-1Gi")
+				peer.Spec.Etcd = &EtcdOptions{QuotaBackendBytes: &quota}
+			},
+			wantErr: true,
+		},
+		{
+			name: "SnapshotCountAndMaxRequestBytes_Allowed",
+			modify: func(peer *EtcdPeer) {
+				var count int64 = 10000
+				max := resource.MustParse("4Mi")
+				peer.Spec.Etcd = &EtcdOptions{SnapshotCount: &count, MaxRequestBytes: &max}
+			},
+		},
+		{
+			name: "ZeroSnapshotCount_Rejected",
+			modify: func(peer *EtcdPeer) {
+				var count int64
+				peer.Spec.Etcd = &EtcdOptions{SnapshotCount: &count}
+			},
+			wantErr: true,
+		},
+		{
+			name: "NegativeMaxRequestBytes_Rejected",
+			modify: func(peer *EtcdPeer) {
+				max := resource.MustParse("-1Mi")
+				peer.Spec.Etcd = &EtcdOptions{MaxRequestBytes: &max}
+			},
+			wantErr: true,
+		},
+		{
+			name: "CrossZoneTiming_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					HeartbeatInterval: &metav1.Duration{Duration: 500 * time.Millisecond},
+					ElectionTimeout:   &metav1.Duration{Duration: 5 * time.Second},
+				}
+			},
+		},
+		{
+			name: "ElectionTimeoutBelowFiveHeartbeats_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					HeartbeatInterval: &metav1.Duration{Duration: 500 * time.Millisecond},
+					ElectionTimeout:   &metav1.Duration{Duration: 2 * time.Second},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "HeartbeatAboveDefaultElectionTimeout_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					HeartbeatInterval: &metav1.Duration{Duration: 300 * time.Millisecond},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ProbeThresholds_Allowed",
+			modify: func(peer *EtcdPeer) {
+				failures, successes := int32(20), int32(2)
+				peer.Spec.PodTemplate = &EtcdPodTemplateSpec{
+					LivenessProbe:  &ProbeThresholds{FailureThreshold: &failures},
+					ReadinessProbe: &ProbeThresholds{SuccessThreshold: &successes},
+				}
+			},
+		},
+		{
+			name: "LivenessSuccessThresholdAboveOne_Rejected",
+			modify: func(peer *EtcdPeer) {
+				successes := int32(2)
+				peer.Spec.PodTemplate = &EtcdPodTemplateSpec{
+					LivenessProbe: &ProbeThresholds{SuccessThreshold: &successes},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExtraVolume_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.PodTemplate = &EtcdPodTemplateSpec{
+					Volumes: []corev1.Volume{
+						{Name: "ca-bundle", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+					},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "ca-bundle", MountPath: "/etc/ssl/certs"},
+					},
+				}
+			},
+		},
+		{
+			name: "ReservedVolumeName_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.PodTemplate = &EtcdPodTemplateSpec{
+					Volumes: []corev1.Volume{
+						{Name: "etcd-data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+					},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ReservedMountPath_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.PodTemplate = &EtcdPodTemplateSpec{
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "my-certs", MountPath: "/etc/etcd/tls/server/"},
+					},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "Sidecar_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.PodTemplate = &EtcdPodTemplateSpec{
+					AdditionalContainers: []corev1.Container{{Name: "log-shipper", Image: "fluent-bit"}},
+				}
+			},
+		},
+		{
+			name: "SidecarNamedEtcd_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.PodTemplate = &EtcdPodTemplateSpec{
+					AdditionalContainers: []corev1.Container{{Name: "etcd", Image: "quay.io/coreos/etcd:v3.4.0"}},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "AdvertiseURLs_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Advertise = &AdvertiseURLs{
+					PeerURLs:   []string{"http://bees.example.com:32380"},
+					ClientURLs: []string{"http://bees.example.com:32379", "http://10.0.0.1:2379/"},
+				}
+			},
+		},
+		{
+			name: "AdvertisePeerURLWithoutTLSScheme_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.TLS = &TLS{PeerSecretName: "bees-peer-tls"}
+				peer.Spec.Advertise = &AdvertiseURLs{
+					PeerURLs: []string{"http://bees.example.com:32380"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "AdvertiseClientURLWithPath_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Advertise = &AdvertiseURLs{
+					ClientURLs: []string{"http://bees.example.com:32379/etcd"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExtraEnvAndArgs_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					ExtraEnv:  []corev1.EnvVar{{Name: "ETCD_AUTO_COMPACTION_RETENTION", Value: "1"}},
+					ExtraArgs: []string{"--max-txn-ops=256", "--debug"},
+				}
+			},
+		},
+		{
+			name: "ExtraEnvOverridingInitialCluster_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					ExtraEnv: []corev1.EnvVar{{Name: "ETCD_INITIAL_CLUSTER", Value: "bees=http://localhost:2380"}},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExtraArgOverridingDataDir_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					ExtraArgs: []string{"-data-dir=/tmp/etcd"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExtraArgOverridingModelledOption_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					ExtraArgs: []string{"--quota-backend-bytes", "8589934592"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExtraArgOverridingSnapshotCount_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					ExtraArgs: []string{"--snapshot-count=5000"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExternalMemberPeerURLs_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap.Static.InitialCluster[1] = InitialClusterMember{
+					Name:     "magic",
+					PeerURLs: []string{"http://etcd.eu-west.example.com:32380"},
+				}
+			},
+		},
+		{
+			name: "MemberWithHostAndPeerURLs_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap.Static.InitialCluster[1].PeerURLs = []string{"http://etcd.eu-west.example.com:32380"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "MemberWithoutHostOrPeerURLs_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap.Static.InitialCluster[1].Host = ""
+			},
+			wantErr: true,
+		},
+		{
+			name: "MemberPeerURLsWithWrongScheme_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap.Static.InitialCluster[1] = InitialClusterMember{
+					Name:     "magic",
+					PeerURLs: []string{"https://etcd.eu-west.example.com:32380"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "OwnPeerURLsAdvertised_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peerURLs := []string{"http://etcd.us-east.example.com:32380"}
+				peer.Spec.Bootstrap.Static.InitialCluster[0] = InitialClusterMember{Name: "bees", PeerURLs: peerURLs}
+				peer.Spec.Advertise = &AdvertiseURLs{PeerURLs: peerURLs}
+			},
+		},
+		{
+			name: "OwnPeerURLsNotAdvertised_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Bootstrap.Static.InitialCluster[0] = InitialClusterMember{
+					Name:     "bees",
+					PeerURLs: []string{"http://etcd.us-east.example.com:32380"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "PeerCIDRs_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.NetworkPolicy = &NetworkPolicy{PeerCIDRs: []string{"10.20.0.0/16", "fd00::/64"}}
+			},
+		},
+		{
+			name: "InvalidPeerCIDR_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.NetworkPolicy = &NetworkPolicy{PeerCIDRs: []string{"10.20.0.0"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "StaleMemberGracePeriod_Allowed",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Membership = &Membership{StaleMemberGracePeriod: &metav1.Duration{Duration: time.Minute}}
+			},
+		},
+		{
+			name: "NegativeStaleMemberGracePeriod_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Membership = &Membership{StaleMemberGracePeriod: &metav1.Duration{Duration: -time.Minute}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "ElectionTimeoutTooLong_Rejected",
+			modify: func(peer *EtcdPeer) {
+				peer.Spec.Etcd = &EtcdOptions{
+					ElectionTimeout: &metav1.Duration{Duration: time.Minute},
+				}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := examplePeer()
+			tt.modify(peer)
+
+			err := peer.ValidateCreate()
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestEtcdPeer_ValidateCreate_EnableV2(t *testing.T) {
+	defer SetEtcdImage("")
+	tests := []struct {
+		name     string
+		image    string
+		enableV2 bool
+		wantErr  bool
+	}{
+		{name: "DisabledBeforeV3_3_Allowed", image: "quay.io/coreos/etcd:v3.2.27", enableV2: false},
+		{name: "EnabledBeforeV3_3_Rejected", image: "quay.io/coreos/etcd:v3.2.27", enableV2: true, wantErr: true},
+		{name: "V3_3_Allowed", image: "quay.io/coreos/etcd:v3.3.17", enableV2: false},
+		{name: "EnabledOnV3_4_Allowed", image: "quay.io/coreos/etcd:v3.4.3", enableV2: true},
+		{name: "EnabledOnV3_6_Rejected", image: "gcr.io/etcd-development/etcd:v3.6.0", enableV2: true, wantErr: true},
+		{name: "DisabledOnV3_6_Allowed", image: "gcr.io/etcd-development/etcd:v3.6.0", enableV2: false},
+		{name: "UnknownVersion_Allowed", image: "registry.example.com:5000/etcd:latest", enableV2: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetEtcdImage(tt.image)
+			peer := examplePeer()
+			peer.Spec.Etcd = &EtcdOptions{EnableV2: &tt.enableV2}
+
+			err := peer.ValidateCreate()
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestEtcdPeer_Default(t *testing.T) {
+	quota := resource.MustParse("4Gi")
+	SetPeerDefaults(EtcdPeerDefaults{
+		Etcd: &EtcdOptions{
+			QuotaBackendBytes: &quota,
+			HeartbeatInterval: &metav1.Duration{Duration: 200 * time.Millisecond},
+		},
+		PodTemplate: &EtcdPodTemplateSpec{
+			PriorityClassName: "etcd-critical",
+			NodeSelector:      map[string]string{"dedicated": "etcd"},
+			Resources: &corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			},
+		},
+	})
+	defer SetPeerDefaults(EtcdPeerDefaults{})
+
+	t.Run("WithoutSettings_SetsDefaults", func(t *testing.T) {
+		peer := examplePeer()
+		peer.Default()
+		require.Equal(t, "4Gi", peer.Spec.Etcd.QuotaBackendBytes.String())
+		require.Equal(t, 200*time.Millisecond, peer.Spec.Etcd.HeartbeatInterval.Duration)
+		require.Nil(t, peer.Spec.Etcd.ElectionTimeout)
+		require.Equal(t, "etcd-critical", peer.Spec.PodTemplate.PriorityClassName)
+		require.Equal(t, "etcd", peer.Spec.PodTemplate.NodeSelector["dedicated"])
+		require.Equal(t, "1Gi", peer.Spec.PodTemplate.Resources.Requests.Memory().String())
+
+		// Peers don't share the defaults.
+		peer.Spec.PodTemplate.NodeSelector["dedicated"] = "other"
+		other := examplePeer()
+		other.Default()
+		require.Equal(t, "etcd", other.Spec.PodTemplate.NodeSelector["dedicated"])
+	})
+	t.Run("WithSettings_KeepsThem", func(t *testing.T) {
+		peer := examplePeer()
+		peer.Spec.Etcd = &EtcdOptions{
+			HeartbeatInterval: &metav1.Duration{Duration: 50 * time.Millisecond},
+		}
+		peer.Spec.PodTemplate = &EtcdPodTemplateSpec{PriorityClassName: "system-cluster-critical"}
+		peer.Default()
+		require.Equal(t, 50*time.Millisecond, peer.Spec.Etcd.HeartbeatInterval.Duration)
+		require.Equal(t, "4Gi", peer.Spec.Etcd.QuotaBackendBytes.String())
+		require.Equal(t, "system-cluster-critical", peer.Spec.PodTemplate.PriorityClassName)
+	})
+	t.Run("WithoutDefaults_LeavesSpecUnset", func(t *testing.T) {
+		SetPeerDefaults(EtcdPeerDefaults{})
+		peer := examplePeer()
+		peer.Default()
+		require.Nil(t, peer.Spec.Etcd)
+		require.Nil(t, peer.Spec.PodTemplate)
+	})
+}
+
+func TestValidatePeerDefaults(t *testing.T) {
+	t.Run("WithValidDefaults_Succeeds", func(t *testing.T) {
+		defaults := EtcdPeerDefaults{
+			PodTemplate: &EtcdPodTemplateSpec{PriorityClassName: "etcd-critical"},
+		}
+		require.Empty(t, ValidatePeerDefaults(field.NewPath("peerDefaults"), defaults, "quay.io/coreos/etcd:v3.2.27"))
+	})
+	t.Run("WithInvalidProbe_ReportsItUnderThePath", func(t *testing.T) {
+		successThreshold := int32(2)
+		defaults := EtcdPeerDefaults{
+			PodTemplate: &EtcdPodTemplateSpec{
+				LivenessProbe: &ProbeThresholds{SuccessThreshold: &successThreshold},
+			},
+		}
+		errs := ValidatePeerDefaults(field.NewPath("peerDefaults"), defaults, "quay.io/coreos/etcd:v3.2.27")
+		require.Len(t, errs, 1)
+		require.Equal(t, "peerDefaults.podTemplate.livenessProbe.successThreshold", errs[0].Field)
+	})
+}
@@ -0,0 +1,76 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EtcdProxySpec defines the desired state of EtcdProxy
+type EtcdProxySpec struct {
+	// ClusterName is the name of the cluster to proxy, as given by the
+	// `clusterName` of its EtcdPeers. The proxy forwards to the peers of
+	// that cluster in the same namespace as the proxy.
+	// +kubebuilder:validation:MinLength=1
+	ClusterName string `json:"clusterName"`
+
+	// Replicas is the number of proxy pods. Defaults to 1.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// ClientSecretName is the name of a Secret of type `kubernetes.io/tls`,
+	// with a `ca.crt`, which the proxy uses to connect to a cluster that
+	// serves clients over TLS. The proxy itself serves plain HTTP.
+	// +optional
+	ClientSecretName string `json:"clientSecretName,omitempty"`
+
+	// Resources are the compute resources of the proxy container.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// EtcdProxyStatus defines the observed state of EtcdProxy
+type EtcdProxyStatus struct {
+	// Replicas is the number of proxy pods.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// ReadyReplicas is the number of proxy pods which are ready.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// Endpoints are the client URLs of the members that the proxy
+	// forwards to.
+	// +optional
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Cluster",type="string",JSONPath=".spec.clusterName"
+// +kubebuilder:printcolumn:name="Replicas",type="integer",JSONPath=".status.replicas"
+// +kubebuilder:printcolumn:name="Ready",type="integer",JSONPath=".status.readyReplicas"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// EtcdProxy runs etcd's gRPC proxy in front of a cluster, giving read heavy
+// clients an endpoint which scales out without adding voting members.
+type EtcdProxy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EtcdProxySpec   `json:"spec,omitempty"`
+	Status EtcdProxyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// EtcdProxyList contains a list of EtcdProxy
+type EtcdProxyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EtcdProxy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EtcdProxy{}, &EtcdProxyList{})
+}
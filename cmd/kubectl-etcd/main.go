@@ -0,0 +1,395 @@
+// Command kubectl-etcd is a kubectl plugin for inspecting etcd clusters run
+// by the operator. Install it on your PATH and run `kubectl etcd`.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
+)
+
+const usage = `Inspect and maintain etcd clusters managed by the etcd-cluster-operator.
+
+Usage:
+  kubectl etcd [flags] members <cluster>
+  kubectl etcd [flags] status <cluster>
+  kubectl etcd [flags] defrag <cluster>
+  kubectl etcd [flags] compact <cluster> --revision N
+
+Commands:
+  members  List the peers of the cluster as recorded in their EtcdPeer status.
+  status   Port-forward to each member and show its leader, raft progress,
+           database size and any alarms raised in the cluster.
+  defrag   Defragment the database of each member in turn, leaving the leader
+           until last. Every member must be healthy before each step.
+  compact  Compact the key space history of the cluster up to a revision.
+           Run defrag afterwards to release the space this frees.
+
+Flags:
+`
+
+const (
+	requestTimeout = 10 * time.Second
+	// maintenanceTimeout bounds each defragmentation or compaction, which
+	// can take minutes on large databases.
+	maintenanceTimeout = 5 * time.Minute
+	// tlsCAKey is the key of the CA certificate in a TLS Secret.
+	tlsCAKey = "ca.crt"
+)
+
+type options struct {
+	kubeconfig string
+	namespace  string
+	caFile     string
+	certFile   string
+	keyFile    string
+	revision   int64
+}
+
+func main() {
+	var opts options
+	flags := flag.NewFlagSet("kubectl-etcd", flag.ExitOnError)
+	flags.StringVar(&opts.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file. Defaults to the kubectl configuration.")
+	flags.StringVar(&opts.namespace, "namespace", "", "Namespace of the cluster. Defaults to the namespace of the current context.")
+	flags.StringVar(&opts.caFile, "cacert", "", "CA bundle used to verify members which serve clients over TLS. Defaults to the one in the peer's client certificate Secret.")
+	flags.StringVar(&opts.certFile, "cert", "", "Client certificate presented to members which serve clients over TLS. Defaults to the peer's client certificate Secret.")
+	flags.StringVar(&opts.keyFile, "key", "", "Key of the client certificate.")
+	flags.Int64Var(&opts.revision, "revision", 0, "Revision to compact the cluster to. Required by compact.")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	args := parseArgs(flags, os.Args[1:])
+	if len(args) != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	command, cluster := args[0], args[1]
+
+	var err error
+	switch command {
+	case "members":
+		err = runMembers(opts, cluster)
+	case "status":
+		err = runStatus(opts, cluster)
+	case "defrag":
+		err = runDefrag(opts, cluster)
+	case "compact":
+		err = runCompact(opts, cluster)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses flags wherever they appear among the arguments, so that
+// they can follow the command as in `compact <cluster> --revision N`. It
+// returns the remaining positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// connect loads the kubectl configuration, returning the REST configuration
+// and the namespace to use.
+func connect(opts options) (*rest.Config, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	namespace := opts.namespace
+	if namespace == "" {
+		if namespace, _, err = clientConfig.Namespace(); err != nil {
+			return nil, "", err
+		}
+	}
+	return config, namespace, nil
+}
+
+// clusterPeers returns the EtcdPeers of the cluster, ordered by name.
+func clusterPeers(ctx context.Context, c client.Client, namespace, cluster string) ([]etcdv1alpha1.EtcdPeer, error) {
+	var list etcdv1alpha1.EtcdPeerList
+	if err := c.List(ctx, &list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var peers []etcdv1alpha1.EtcdPeer
+	for _, peer := range list.Items {
+		if peer.Spec.ClusterName == cluster {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no EtcdPeers found for cluster %q in namespace %q", cluster, namespace)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	return peers, nil
+}
+
+func newClient(config *rest.Config) (client.Client, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := etcdv1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	return client.New(config, client.Options{Scheme: scheme})
+}
+
+func runMembers(opts options, cluster string) error {
+	config, namespace, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	peers, err := clusterPeers(ctx, c, namespace, cluster)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tREADY\tMEMBER ID\tVERSION\tDB SIZE")
+	for _, peer := range peers {
+		ready := string(corev1.ConditionUnknown)
+		for _, condition := range peer.Status.Conditions {
+			if condition.Type == etcdv1alpha1.EtcdPeerReady {
+				ready = string(condition.Status)
+			}
+		}
+		dbSize := ""
+		if peer.Status.DBSize != nil {
+			dbSize = peer.Status.DBSize.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", peer.Name, ready, peer.Status.MemberID, peer.Status.Version, dbSize)
+	}
+	return w.Flush()
+}
+
+func runStatus(opts options, cluster string) error {
+	config, namespace, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	peers, err := clusterPeers(ctx, c, namespace, cluster)
+	if err != nil {
+		return err
+	}
+
+	var alarms []etcd.Alarm
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMEMBER ID\tLEADER\tVERSION\tDB SIZE\tRAFT TERM\tRAFT INDEX\tERROR")
+	for _, peer := range peers {
+		status, peerAlarms, err := memberStatus(opts, config, c, peer)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t\t\t\t\t\t\t%s\n", peer.Name, err)
+			continue
+		}
+		// Every member reports the alarms of the whole cluster.
+		alarms = peerAlarms
+		leader := ""
+		if status.MemberID == status.Leader {
+			leader = "*"
+		}
+		fmt.Fprintf(w, "%s\t%x\t%s\t%s\t%d\t%d\t%d\t\n",
+			peer.Name, status.MemberID, leader, status.Version, status.DBSize, status.RaftTerm, status.RaftIndex)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(alarms) == 0 {
+		fmt.Println("\nNo alarms raised.")
+		return nil
+	}
+	fmt.Println("\nALARMS:")
+	for _, alarm := range alarms {
+		fmt.Printf("  %s on member %x\n", alarm.Alarm, alarm.MemberID)
+	}
+	return nil
+}
+
+// member is a port-forwarded connection to the etcd member of a peer.
+type member struct {
+	peer       etcdv1alpha1.EtcdPeer
+	httpClient *http.Client
+	endpoint   *url.URL
+	forward    *portForward
+	// memberID is filled in once the member has been queried.
+	memberID uint64
+}
+
+func (m *member) Close() {
+	m.forward.Close()
+}
+
+// connectMember port-forwards to the peer's pod. The caller must close the
+// returned member.
+func connectMember(ctx context.Context, opts options, config *rest.Config, c client.Client, peer etcdv1alpha1.EtcdPeer) (*member, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(peer.Namespace), client.MatchingLabels{etcdv1alpha1.PeerLabel: peer.Name}); err != nil {
+		return nil, err
+	}
+	var pod *corev1.Pod
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning {
+			pod = &pods.Items[i]
+			break
+		}
+	}
+	if pod == nil {
+		return nil, errors.New("no running pod")
+	}
+
+	httpClient, scheme, err := memberHTTPClient(ctx, opts, c, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	forward, err := forwardPort(config, pod, etcdv1alpha1.ClientPort)
+	if err != nil {
+		return nil, err
+	}
+	return &member{
+		peer:       peer,
+		httpClient: httpClient,
+		endpoint:   forward.URL(scheme),
+		forward:    forward,
+	}, nil
+}
+
+// memberStatus port-forwards to the peer's pod and queries its etcd member.
+// Each member has its own timeout, so that one which doesn't answer leaves
+// time for the others.
+func memberStatus(opts options, config *rest.Config, c client.Client, peer etcdv1alpha1.EtcdPeer) (*etcd.MemberStatus, []etcd.Alarm, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	m, err := connectMember(ctx, opts, config, c, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer m.Close()
+
+	status, err := etcd.FetchMemberStatus(ctx, m.httpClient, m.endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	alarms, err := etcd.FetchAlarms(ctx, m.httpClient, m.endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return status, alarms, nil
+}
+
+// memberHTTPClient returns a client for the peer's member, and the scheme it
+// serves clients with. Members which serve clients over TLS need a client
+// certificate. The one given by the flags is used if there is one, otherwise
+// the peer's client certificate is read from its Secret, as the operator does.
+func memberHTTPClient(ctx context.Context, opts options, c client.Client, peer etcdv1alpha1.EtcdPeer) (*http.Client, string, error) {
+	// Requests are bounded by their contexts instead, as defragmenting a
+	// member can take minutes.
+	httpClient := &http.Client{}
+	scheme := peer.ClientScheme()
+	if peer.ServerTLSSecretName() == "" {
+		return httpClient, scheme, nil
+	}
+
+	var certPEM, keyPEM, caPEM []byte
+	switch {
+	case opts.caFile != "" || opts.certFile != "" || opts.keyFile != "":
+		if opts.caFile == "" || opts.certFile == "" || opts.keyFile == "" {
+			return nil, "", errors.New("--cacert, --cert and --key must be given together")
+		}
+		var err error
+		if certPEM, err = ioutil.ReadFile(opts.certFile); err != nil {
+			return nil, "", err
+		}
+		if keyPEM, err = ioutil.ReadFile(opts.keyFile); err != nil {
+			return nil, "", err
+		}
+		if caPEM, err = ioutil.ReadFile(opts.caFile); err != nil {
+			return nil, "", err
+		}
+	case peer.ClientTLSSecretName() != "":
+		var secret corev1.Secret
+		key := client.ObjectKey{Namespace: peer.Namespace, Name: peer.ClientTLSSecretName()}
+		if err := c.Get(ctx, key, &secret); err != nil {
+			return nil, "", fmt.Errorf("unable to read the client certificate, pass --cacert, --cert and --key instead: %w", err)
+		}
+		certPEM = secret.Data[corev1.TLSCertKey]
+		keyPEM = secret.Data[corev1.TLSPrivateKeyKey]
+		caPEM = secret.Data[tlsCAKey]
+	default:
+		return nil, "", errors.New("the member serves clients over TLS and the peer has no client certificate, pass --cacert, --cert and --key")
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, "", err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, "", errors.New("no CA certificates found for the member")
+	}
+	httpClient.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      roots,
+			// Connections arrive through the port-forward, and the
+			// certificates issued by the operator are valid for localhost.
+			ServerName: "localhost",
+		},
+	}
+	return httpClient, scheme, nil
+}
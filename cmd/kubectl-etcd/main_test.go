@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+func selfSignedCertificate(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bees"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestMemberHTTPClient_WithoutTLS_UsesHTTP(t *testing.T) {
+	_, scheme, err := memberHTTPClient(context.Background(), options{}, nil, etcdv1alpha1.EtcdPeer{})
+	require.NoError(t, err)
+	require.Equal(t, "http", scheme)
+}
+
+func TestMemberHTTPClient_WithTLSAndNoCertificate_Fails(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			TLS: &etcdv1alpha1.TLS{ServerSecretName: "bees-server-tls"},
+		},
+	}
+	_, _, err := memberHTTPClient(context.Background(), options{}, nil, peer)
+	require.Error(t, err)
+}
+
+func TestMemberHTTPClient_WithClientSecret_ReadsIt(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			TLS: &etcdv1alpha1.TLS{ServerSecretName: "bees-server-tls", ClientSecretName: "bees-client-tls"},
+		},
+	}
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+
+	c := fake.NewFakeClientWithScheme(scheme)
+	_, _, err := memberHTTPClient(context.Background(), options{}, c, peer)
+	require.Error(t, err, "the Secret doesn't exist yet")
+
+	certPEM, keyPEM := selfSignedCertificate(t)
+	c = fake.NewFakeClientWithScheme(scheme, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees-client-tls", Namespace: "default"},
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       certPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+			tlsCAKey:                certPEM,
+		},
+	})
+	httpClient, httpScheme, err := memberHTTPClient(context.Background(), options{}, c, peer)
+	require.NoError(t, err)
+	require.Equal(t, "https", httpScheme)
+	require.NotNil(t, httpClient.Transport)
+}
+
+func TestParseArgs_WithFlagsAfterCommand_ParsesThem(t *testing.T) {
+	var revision int64
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Int64Var(&revision, "revision", 0, "")
+
+	args := parseArgs(flags, []string{"compact", "bees", "--revision", "42"})
+	require.Equal(t, []string{"compact", "bees"}, args)
+	require.Equal(t, int64(42), revision)
+}
+
+func TestDefragOrder_WithLeader_LeavesLeaderLast(t *testing.T) {
+	a, b, c := &member{memberID: 1}, &member{memberID: 2}, &member{memberID: 3}
+	require.Equal(t, []*member{a, c, b}, defragOrder([]*member{a, b, c}, 2))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
+)
+
+func runDefrag(opts options, cluster string) error {
+	config, namespace, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	peers, err := clusterPeers(ctx, c, namespace, cluster)
+	if err != nil {
+		return err
+	}
+
+	var members []*member
+	defer func() {
+		for _, m := range members {
+			m.Close()
+		}
+	}()
+	var leader uint64
+	for _, peer := range peers {
+		m, err := connectMember(ctx, opts, config, c, peer)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", peer.Name, err)
+		}
+		members = append(members, m)
+		status, err := checkHealthy(ctx, m)
+		if err != nil {
+			return err
+		}
+		leader = status.Leader
+		m.memberID = status.MemberID
+	}
+
+	// Defragmenting the leader stalls the cluster while it runs, so do it
+	// last, and only once the others have come back healthy.
+	for _, m := range defragOrder(members, leader) {
+		if err := defragMember(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defragOrder returns the members with the leader moved to the end.
+func defragOrder(members []*member, leader uint64) []*member {
+	var ordered []*member
+	var last *member
+	for _, m := range members {
+		if m.memberID == leader {
+			last = m
+			continue
+		}
+		ordered = append(ordered, m)
+	}
+	if last != nil {
+		ordered = append(ordered, last)
+	}
+	return ordered
+}
+
+// defragMember defragments a single member, and checks it is healthy again
+// before returning.
+func defragMember(m *member) error {
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceTimeout)
+	defer cancel()
+
+	before, err := checkHealthy(ctx, m)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Defragmenting %s (%d bytes)...\n", m.peer.Name, before.DBSize)
+	if err := etcd.Defragment(ctx, m.httpClient, m.endpoint); err != nil {
+		return fmt.Errorf("peer %s: %w", m.peer.Name, err)
+	}
+	after, err := checkHealthy(ctx, m)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Defragmented %s (%d bytes)\n", m.peer.Name, after.DBSize)
+	return nil
+}
+
+// checkHealthy returns the status of the member, or an error if it is not
+// healthy.
+func checkHealthy(ctx context.Context, m *member) (*etcd.MemberStatus, error) {
+	status, err := etcd.FetchMemberStatus(ctx, m.httpClient, m.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s: %w", m.peer.Name, err)
+	}
+	if !status.Healthy {
+		return nil, fmt.Errorf("peer %s is not healthy, not continuing", m.peer.Name)
+	}
+	return status, nil
+}
+
+func runCompact(opts options, cluster string) error {
+	if opts.revision <= 0 {
+		return errors.New("compact needs a positive --revision")
+	}
+	config, namespace, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceTimeout)
+	defer cancel()
+
+	peers, err := clusterPeers(ctx, c, namespace, cluster)
+	if err != nil {
+		return err
+	}
+
+	// Compaction applies to the whole cluster, so it only needs to be asked
+	// of one healthy member.
+	for _, peer := range peers {
+		m, err := connectMember(ctx, opts, config, c, peer)
+		if err != nil {
+			fmt.Printf("Skipping %s: %s\n", peer.Name, err)
+			continue
+		}
+		defer m.Close()
+		if _, err := checkHealthy(ctx, m); err != nil {
+			fmt.Printf("Skipping %s: %s\n", peer.Name, err)
+			continue
+		}
+		if err := etcd.Compact(ctx, m.httpClient, m.endpoint, opts.revision); err != nil {
+			return err
+		}
+		fmt.Printf("Compacted cluster %s to revision %d\n", cluster, opts.revision)
+		return nil
+	}
+	return fmt.Errorf("no healthy member of cluster %q to compact", cluster)
+}
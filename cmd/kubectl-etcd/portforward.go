@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// portForward is a running port-forward to a pod, listening on a local port
+// chosen by the system.
+type portForward struct {
+	localPort uint16
+	stop      chan struct{}
+}
+
+// forwardPort starts forwarding a local port to `port` on the pod, and waits
+// until it is ready.
+func forwardPort(config *rest.Config, pod *corev1.Pod, port int) (*portForward, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, err
+	}
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+
+	stop := make(chan struct{})
+	ready := make(chan struct{})
+	forwarder, err := portforward.NewOnAddresses(dialer, []string{"localhost"}, []string{fmt.Sprintf("0:%d", port)},
+		stop, ready, ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- forwarder.ForwardPorts() }()
+	select {
+	case <-ready:
+	case err := <-errs:
+		return nil, fmt.Errorf("unable to port-forward to pod %s: %w", pod.Name, err)
+	}
+
+	ports, err := forwarder.GetPorts()
+	if err != nil {
+		close(stop)
+		return nil, err
+	}
+	return &portForward{localPort: ports[0].Local, stop: stop}, nil
+}
+
+// URL returns the base URL of the forwarded port.
+func (f *portForward) URL(scheme string) *url.URL {
+	return &url.URL{Scheme: scheme, Host: fmt.Sprintf("localhost:%d", f.localPort)}
+}
+
+// Close stops forwarding.
+func (f *portForward) Close() {
+	close(f.stop)
+}
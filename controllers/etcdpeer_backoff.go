@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// backoffBase is the delay before retrying after the first transient
+	// error. It doubles with each consecutive one, up to backoffMax.
+	backoffBase = 1 * time.Second
+	backoffMax  = 5 * time.Minute
+	// backoffJitter spreads retries by up to this fraction of the delay, so
+	// that peers which failed together don't retry together.
+	backoffJitter = 0.5
+)
+
+// requeueBackoff counts the consecutive transient errors of each peer, to work
+// out how long to wait before reconciling it again. The zero value is ready to
+// use.
+type requeueBackoff struct {
+	mu       sync.Mutex
+	failures map[types.NamespacedName]int
+}
+
+// Next records another failure of the peer and returns the delay before it
+// should be retried.
+func (b *requeueBackoff) Next(name types.NamespacedName) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures == nil {
+		b.failures = make(map[types.NamespacedName]int)
+	}
+	failures := b.failures[name]
+	b.failures[name] = failures + 1
+
+	delay := backoffBase
+	for i := 0; i < failures && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	return wait.Jitter(delay, backoffJitter)
+}
+
+// Reset forgets the failures of the peer, once it has been reconciled
+// successfully or deleted.
+func (b *requeueBackoff) Reset(name types.NamespacedName) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, name)
+}
+
+// isTransient reports whether an error is likely to go away by itself, such as
+// an API server which is overloaded or a write which raced with another. Other
+// errors are returned to controller-runtime, which logs and counts them.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var statusErr *apierrs.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return apierrs.IsConflict(statusErr) ||
+		apierrs.IsServerTimeout(statusErr) ||
+		apierrs.IsTimeout(statusErr) ||
+		apierrs.IsTooManyRequests(statusErr) ||
+		apierrs.IsServiceUnavailable(statusErr) ||
+		apierrs.IsInternalError(statusErr)
+}
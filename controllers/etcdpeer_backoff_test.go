@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRequeueBackoff_WithRepeatedFailures_DoublesUpToMax(t *testing.T) {
+	var b requeueBackoff
+	name := types.NamespacedName{Namespace: "default", Name: "bees-0"}
+
+	for _, base := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		delay := b.Next(name)
+		require.True(t, delay >= base && delay <= time.Duration(float64(base)*(1+backoffJitter)),
+			"delay %s outside the range for %s", delay, base)
+	}
+	for i := 0; i < 20; i++ {
+		b.Next(name)
+	}
+	delay := b.Next(name)
+	require.True(t, delay >= backoffMax && delay <= time.Duration(float64(backoffMax)*(1+backoffJitter)))
+}
+
+func TestRequeueBackoff_AfterReset_StartsAgain(t *testing.T) {
+	var b requeueBackoff
+	name := types.NamespacedName{Namespace: "default", Name: "bees-0"}
+	other := types.NamespacedName{Namespace: "default", Name: "bees-1"}
+
+	b.Next(name)
+	b.Next(name)
+	b.Next(other)
+	b.Reset(name)
+
+	require.True(t, b.Next(name) < 2*backoffBase)
+	require.True(t, b.Next(other) >= 2*backoffBase)
+}
+
+func TestIsTransient_WithErrors_ClassifiesThem(t *testing.T) {
+	resource := schema.GroupResource{Group: "apps", Resource: "replicasets"}
+	conflict := apierrs.NewConflict(resource, "bees-0", errors.New("modified"))
+
+	require.True(t, isTransient(conflict))
+	require.True(t, isTransient(fmt.Errorf("unable to patch: %w", conflict)))
+	require.True(t, isTransient(apierrs.NewTooManyRequests("slow down", 1)))
+	require.True(t, isTransient(context.DeadlineExceeded))
+	require.False(t, isTransient(apierrs.NewForbidden(resource, "bees-0", errors.New("denied"))))
+	require.False(t, isTransient(errors.New("spec.clusterName changed")))
+}
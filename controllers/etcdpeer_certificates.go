@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+const (
+	// certificateRequeueInterval is how often we check whether cert-manager
+	// has issued the certificates for a peer which is waiting for them.
+	certificateRequeueInterval = 5 * time.Second
+	defaultIssuerKind          = "Issuer"
+
+	// operatorClientCommonName is the common name of the client certificates
+	// issued for the operator.
+	operatorClientCommonName = "etcd-cluster-operator"
+)
+
+// certificateGVK is the cert-manager Certificate kind. We use unstructured
+// objects for these so that cert-manager is only needed by users of the
+// `issuerRef` option.
+var certificateGVK = schema.GroupVersionKind{
+	Group:   "certmanager.k8s.io",
+	Version: "v1alpha1",
+	Kind:    "Certificate",
+}
+
+// +kubebuilder:rbac:groups=certmanager.k8s.io,resources=certificates,verbs=get;create;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get
+
+// defineCertificate builds a cert-manager Certificate for the peer, issued by
+// the peer's issuer and stored in `secretName`. The same certificate is used
+// both to serve and to dial, so it is valid for the peer's advertised host
+// name and for local connections from inside the pod.
+func defineCertificate(peer etcdv1alpha1.EtcdPeer, secretName, clusterDomain string) *unstructured.Unstructured {
+	// The short name keeps the common name within its 64 character limit.
+	dnsNames := []interface{}{advertiseHost(peer, "")}
+	if clusterDomain != "" {
+		dnsNames = append(dnsNames, advertiseHost(peer, clusterDomain))
+	}
+	dnsNames = append(dnsNames, "localhost")
+
+	// Overridden advertise URLs must be valid for the certificate too.
+	var ipAddresses []interface{}
+	seen := map[string]bool{}
+	for _, host := range overriddenAdvertiseHosts(peer) {
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		if net.ParseIP(host) != nil {
+			ipAddresses = append(ipAddresses, host)
+		} else {
+			dnsNames = append(dnsNames, host)
+		}
+	}
+
+	spec := map[string]interface{}{
+		"secretName": secretName,
+		"commonName": advertiseHost(peer, ""),
+		"dnsNames":   dnsNames,
+		"issuerRef":  certificateIssuerRef(peer),
+	}
+	if len(ipAddresses) > 0 {
+		spec["ipAddresses"] = ipAddresses
+	}
+	return newCertificate(peer, secretName, spec)
+}
+
+// defineClientCertificate builds a cert-manager Certificate for the operator
+// to authenticate itself to the peer's member, stored in `secretName`. It is
+// only valid as a client certificate.
+func defineClientCertificate(peer etcdv1alpha1.EtcdPeer, secretName string) *unstructured.Unstructured {
+	return newCertificate(peer, secretName, map[string]interface{}{
+		"secretName": secretName,
+		"commonName": operatorClientCommonName,
+		"usages":     []interface{}{"digital signature", "key encipherment", "client auth"},
+		"issuerRef":  certificateIssuerRef(peer),
+	})
+}
+
+func certificateIssuerRef(peer etcdv1alpha1.EtcdPeer) map[string]interface{} {
+	issuerKind := peer.Spec.TLS.IssuerRef.Kind
+	if issuerKind == "" {
+		issuerKind = defaultIssuerKind
+	}
+	return map[string]interface{}{
+		"name": peer.Spec.TLS.IssuerRef.Name,
+		"kind": issuerKind,
+	}
+}
+
+// newCertificate returns a Certificate named after its Secret, labelled and
+// owned by the peer.
+func newCertificate(peer etcdv1alpha1.EtcdPeer, secretName string, spec map[string]interface{}) *unstructured.Unstructured {
+	certificate := &unstructured.Unstructured{
+		Object: map[string]interface{}{"spec": spec},
+	}
+	certificate.SetGroupVersionKind(certificateGVK)
+	certificate.SetName(secretName)
+	certificate.SetNamespace(peer.Namespace)
+	certificate.SetLabels(map[string]string{
+		appLabel:     appName,
+		clusterLabel: peer.Spec.ClusterName,
+		peerLabel:    peer.Name,
+	})
+	certificate.SetOwnerReferences([]metav1.OwnerReference{
+		*metav1.NewControllerRef(&peer, etcdv1alpha1.GroupVersion.WithKind("EtcdPeer")),
+	})
+	return certificate
+}
+
+// overriddenAdvertiseHosts returns the hosts of the peer and client URLs which
+// the peer advertises in place of its own name.
+func overriddenAdvertiseHosts(peer etcdv1alpha1.EtcdPeer) []string {
+	if peer.Spec.Advertise == nil {
+		return nil
+	}
+	var hosts []string
+	urls := append(append([]string{}, peer.Spec.Advertise.PeerURLs...), peer.Spec.Advertise.ClientURLs...)
+	for _, raw := range urls {
+		// The webhook checks that these parse.
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+// certificateDrifted reports whether any of the spec fields set by
+// defineCertificate differ on the existing Certificate. Fields which were
+// defaulted, or set by someone else, are ignored.
+func certificateDrifted(existing, desired *unstructured.Unstructured) bool {
+	for key, value := range desired.Object["spec"].(map[string]interface{}) {
+		actual, _, _ := unstructured.NestedFieldNoCopy(existing.Object, "spec", key)
+		if !apiequality.Semantic.DeepEqual(actual, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileCertificates creates any missing Certificates for a peer using an
+// issuer, including the operator's own client certificate, and reports
+// whether all of their Secrets have been issued yet.
+//
+// Renewed certificates are written into the same Secrets. The kubelet updates
+// the mounted files in place and etcd reloads its certificates for each new
+// connection, so there is no need to restart the pod.
+func (r *EtcdPeerReconciler) reconcileCertificates(ctx context.Context, log logr.Logger, peer etcdv1alpha1.EtcdPeer) (bool, error) {
+	ready := true
+	certificates := []*unstructured.Unstructured{
+		defineCertificate(peer, peer.PeerTLSSecretName(), r.ClusterDomain),
+		defineCertificate(peer, peer.ServerTLSSecretName(), r.ClusterDomain),
+		defineClientCertificate(peer, peer.ClientTLSSecretName()),
+	}
+	for _, desired := range certificates {
+		secretName := desired.GetName()
+
+		existing := &unstructured.Unstructured{}
+		existing.SetGroupVersionKind(certificateGVK)
+		err := r.Get(ctx, client.ObjectKey{Namespace: peer.Namespace, Name: desired.GetName()}, existing)
+		if apierrs.IsNotFound(err) {
+			log.V(1).Info("Certificate does not exist, creating", "certificate", desired.GetName())
+			if err := r.Create(ctx, desired); err != nil {
+				log.Error(err, "unable to create Certificate for EtcdPeer", "certificate", desired.GetName())
+				r.Recorder.Eventf(&peer, corev1.EventTypeWarning, eventReasonCreateFailed,
+					"Failed to create Certificate %s: %s", desired.GetName(), err)
+				return false, err
+			}
+			r.Recorder.Eventf(&peer, corev1.EventTypeNormal, eventReasonCertificateCreated,
+				"Created Certificate %s", desired.GetName())
+		} else if err != nil {
+			log.Error(err, "unable to query for certificates")
+			return false, err
+		} else if certificateDrifted(existing, desired) {
+			// cert-manager reissues the certificate when its spec changes.
+			log.V(1).Info("Certificate has drifted, patching", "certificate", desired.GetName())
+			patch := client.MergeFrom(existing.DeepCopy())
+			for key, value := range desired.Object["spec"].(map[string]interface{}) {
+				if err := unstructured.SetNestedField(existing.Object, value, "spec", key); err != nil {
+					return false, err
+				}
+			}
+			if err := r.Patch(ctx, existing, patch); err != nil {
+				log.Error(err, "unable to patch Certificate for EtcdPeer", "certificate", desired.GetName())
+				return false, err
+			}
+		}
+
+		var secret corev1.Secret
+		err = r.APIReader.Get(ctx, client.ObjectKey{Namespace: peer.Namespace, Name: secretName}, &secret)
+		if apierrs.IsNotFound(err) {
+			ready = false
+			continue
+		}
+		if err != nil {
+			log.Error(err, "unable to query for certificate secrets")
+			return false, err
+		}
+		for _, key := range []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey, tlsCAKey} {
+			if len(secret.Data[key]) == 0 {
+				ready = false
+			}
+		}
+	}
+	return ready, nil
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+func TestCertificateDrifted_WithDefaultedFields_IgnoresThem(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			TLS: &etcdv1alpha1.TLS{
+				IssuerRef: &etcdv1alpha1.IssuerReference{Name: "etcd-ca"},
+			},
+		},
+	}
+	desired := defineCertificate(peer, "bees-peer-tls", "cluster.local")
+
+	existing := desired.DeepCopy()
+	require.NoError(t, unstructured.SetNestedField(existing.Object, "2160h", "spec", "duration"))
+	require.False(t, certificateDrifted(existing, desired))
+
+	require.NoError(t, unstructured.SetNestedField(existing.Object, "other-ca", "spec", "issuerRef", "name"))
+	require.True(t, certificateDrifted(existing, desired))
+}
+
+func TestDefineClientCertificate_OnlyValidForClientAuth(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			TLS: &etcdv1alpha1.TLS{
+				IssuerRef: &etcdv1alpha1.IssuerReference{Name: "etcd-ca"},
+			},
+		},
+	}
+	certificate := defineClientCertificate(peer, peer.ClientTLSSecretName())
+
+	require.Equal(t, "bees-client-tls", certificate.GetName())
+	usages, _, err := unstructured.NestedSlice(certificate.Object, "spec", "usages")
+	require.NoError(t, err)
+	require.Contains(t, usages, "client auth")
+	require.NotContains(t, usages, "server auth")
+	_, found, _ := unstructured.NestedFieldNoCopy(certificate.Object, "spec", "dnsNames")
+	require.False(t, found)
+}
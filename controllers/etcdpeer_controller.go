@@ -2,81 +2,564 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"net"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
 )
 
 // EtcdPeerReconciler reconciles a EtcdPeer object
 type EtcdPeerReconciler struct {
 	client.Client
 	Log logr.Logger
+	// APIReader reads Secrets straight from the API server. Reading them
+	// through the cached Client would watch every Secret the operator can
+	// see.
+	APIReader client.Reader
+
+	// EtcdImage is the image used for the etcd container of each peer.
+	EtcdImage string
+	// ReconcileTimeout is how long a single reconcile may take.
+	ReconcileTimeout time.Duration
+	// ClusterDomain is the DNS domain of the Kubernetes cluster, which
+	// qualifies the host names that peers advertise.
+	ClusterDomain string
+	// Recorder records Events against the EtcdPeer for the actions taken
+	// on its behalf.
+	Recorder record.EventRecorder
+	// EtcdClients are the clients used to query etcd members, shared
+	// between reconciles.
+	EtcdClients *etcd.Clients
+	// RemoveStaleMembers has members which no longer belong to any EtcdPeer
+	// removed from their cluster, once they have been stale for
+	// StaleMemberGracePeriod. Both can be overridden by the spec.membership
+	// of the peer whose member is the leader.
+	RemoveStaleMembers     bool
+	StaleMemberGracePeriod time.Duration
+
+	backoff         requeueBackoff
+	staleMembers    staleMemberTracker
+	podReplacements podReplacementTracker
 }
 
 const (
-	etcdImage                     = "quay.io/coreos/etcd:v3.2.27"
-	etcdAdvertiseClientURLsEnvVar = "ETCD_ADVERTISE_CLIENT_URLS"
-	etcdInitialClusterEnvVar      = "ETCD_INITIAL_CLUSTER"
-	etcdNameEnvVar                = "ETCD_NAME"
-	etcdScheme                    = "http"
-	etcdPeerPort                  = 2380
-	appName                       = "etcd"
-	appLabel                      = "app.kubernetes.io/app"
-	clusterLabel                  = "etcd.improbable.io/cluster-name"
-	peerLabel                     = "etcd.improbable.io/peer-name"
+	etcdAdvertiseClientURLsEnvVar      = "ETCD_ADVERTISE_CLIENT_URLS"
+	etcdInitialAdvertisePeerURLsEnvVar = "ETCD_INITIAL_ADVERTISE_PEER_URLS"
+	etcdListenClientURLsEnvVar         = "ETCD_LISTEN_CLIENT_URLS"
+	etcdListenPeerURLsEnvVar           = "ETCD_LISTEN_PEER_URLS"
+	etcdInitialClusterEnvVar           = "ETCD_INITIAL_CLUSTER"
+	etcdNameEnvVar                     = "ETCD_NAME"
+	etcdEnableV2EnvVar                 = "ETCD_ENABLE_V2"
+	etcdQuotaBackendBytesEnvVar        = "ETCD_QUOTA_BACKEND_BYTES"
+	etcdHeartbeatIntervalEnvVar        = "ETCD_HEARTBEAT_INTERVAL"
+	etcdElectionTimeoutEnvVar          = "ETCD_ELECTION_TIMEOUT"
+	etcdSnapshotCountEnvVar            = "ETCD_SNAPSHOT_COUNT"
+	etcdMaxRequestBytesEnvVar          = "ETCD_MAX_REQUEST_BYTES"
+	etcdDataDirEnvVar                  = "ETCD_DATA_DIR"
+	etcdCertFileEnvVar                 = "ETCD_CERT_FILE"
+	etcdKeyFileEnvVar                  = "ETCD_KEY_FILE"
+	etcdTrustedCAFileEnvVar            = "ETCD_TRUSTED_CA_FILE"
+	etcdClientCertAuthEnvVar           = "ETCD_CLIENT_CERT_AUTH"
+	etcdPeerCertFileEnvVar             = "ETCD_PEER_CERT_FILE"
+	etcdPeerKeyFileEnvVar              = "ETCD_PEER_KEY_FILE"
+	etcdPeerTrustedCAFileEnvVar        = "ETCD_PEER_TRUSTED_CA_FILE"
+	etcdPeerClientCertAuthEnvVar       = "ETCD_PEER_CLIENT_CERT_AUTH"
+	podIPEnvVar                        = "POD_IP"
+	etcdBinary                         = "/usr/local/bin/etcd"
+	etcdSchemeHTTP                     = "http"
+	etcdSchemeHTTPS                    = "https"
+	etcdClientPort                     = etcdv1alpha1.ClientPort
+	etcdPeerPort                       = etcdv1alpha1.PeerPort
+	dataVolumeName                     = etcdv1alpha1.DataVolumeName
+	dataMountPath                      = etcdv1alpha1.DataMountPath
+	peerTLSVolumeName                  = etcdv1alpha1.PeerTLSVolumeName
+	peerTLSMountPath                   = etcdv1alpha1.PeerTLSMountPath
+	serverTLSVolumeName                = etcdv1alpha1.ServerTLSVolumeName
+	serverTLSMountPath                 = etcdv1alpha1.ServerTLSMountPath
+	clientTLSVolumeName                = etcdv1alpha1.ClientTLSVolumeName
+	clientTLSMountPath                 = etcdv1alpha1.ClientTLSMountPath
+	tlsCAKey                           = "ca.crt"
+	appName                            = etcdv1alpha1.AppName
+	appLabel                           = etcdv1alpha1.AppLabel
+	clusterLabel                       = etcdv1alpha1.ClusterLabel
+	peerLabel                          = etcdv1alpha1.PeerLabel
+	podTemplateHashAnnotation          = "etcd.improbable.io/pod-template-hash"
+	initialClusterAnnotation           = "etcd.improbable.io/initial-cluster"
+)
+
+// Reasons used for the Events recorded against an EtcdPeer.
+const (
+	eventReasonReplicaSetCreated  = "ReplicaSetCreated"
+	eventReasonReplicaSetUpdated  = "ReplicaSetUpdated"
+	eventReasonPodReplaced        = "PodReplaced"
+	eventReasonCertificateCreated = "CertificateCreated"
+	eventReasonPolicyCreated      = "NetworkPolicyCreated"
+	eventReasonCreateFailed       = "CreateFailed"
+	eventReasonIdentityChanged    = "IdentityChanged"
+	eventReasonInvalidSpec        = "InvalidSpec"
+	eventReasonMemberReady        = "MemberReady"
+	eventReasonMemberNotReady     = "MemberNotReady"
+
+	eventReasonStaleMemberRemoving     = "StaleMemberRemoving"
+	eventReasonStaleMemberRemoved      = "StaleMemberRemoved"
+	eventReasonStaleMemberRemoveFailed = "StaleMemberRemoveFailed"
 )
 
 // +kubebuilder:rbac:groups=etcd.improbable.io,resources=etcdpeers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=etcd.improbable.io,resources=etcdpeers/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups=apps,resources=replicaset,verbs=get;update;patch;create
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch;update;patch;create
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
-func initialMemberURL(member etcdv1alpha1.InitialClusterMember) *url.URL {
+// initialMemberURL builds the peer URL of a member of the initial cluster
+// from its host. Hosts in the cluster's own Service domain are qualified in
+// the same way as the host that the peer advertises, so that a peer's entry
+// matches the URL it advertises.
+func initialMemberURL(member etcdv1alpha1.InitialClusterMember, scheme, clusterDomain string) *url.URL {
 	return &url.URL{
-		Scheme: etcdScheme,
-		Host:   fmt.Sprintf("%s:%d", member.Host, etcdPeerPort),
+		Scheme: scheme,
+		Host:   hostPort(qualifyHost(member.Host, clusterDomain), etcdPeerPort),
 	}
 }
 
+// qualifyHost appends the cluster domain to a host name ending in `.svc`.
+// Other hosts are left alone.
+func qualifyHost(host, clusterDomain string) string {
+	if clusterDomain == "" || !strings.HasSuffix(host, ".svc") {
+		return host
+	}
+	return host + "." + clusterDomain
+}
+
+// hostPort joins a host and port, bracketing the host if it is an IPv6
+// address. The host may already be bracketed.
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+}
+
+// usesIPv6 reports whether etcd should listen on IPv6 rather than IPv4.
+func usesIPv6(peer etcdv1alpha1.EtcdPeer) bool {
+	return peer.Spec.IPFamily == etcdv1alpha1.IPv6Family
+}
+
 // staticBootstrapInitialCluster returns the value of `ETCD_INITIAL_CLUSTER`
 // environment variable.
-func staticBootstrapInitialCluster(static etcdv1alpha1.StaticBootstrap) string {
-	s := make([]string, len(static.InitialCluster))
+// Members with several peer URLs have an entry for each of them.
+func staticBootstrapInitialCluster(static etcdv1alpha1.StaticBootstrap, scheme, clusterDomain string) string {
+	var s []string
 	// Put our peers in as the other entries
-	for i, member := range static.InitialCluster {
-		s[i] = fmt.Sprintf("%s=%s",
+	for _, member := range static.InitialCluster {
+		if len(member.PeerURLs) > 0 {
+			for _, peerURL := range member.PeerURLs {
+				s = append(s, fmt.Sprintf("%s=%s", member.Name, peerURL))
+			}
+			continue
+		}
+		s = append(s, fmt.Sprintf("%s=%s",
 			member.Name,
-			initialMemberURL(member).String())
+			initialMemberURL(member, scheme, clusterDomain).String()))
 	}
 	return strings.Join(s, ",")
 }
 
+// advertiseHost builds the canonical host name of this peer from it's name
+// and the cluster name. This is the name given to the pod by its hostname and
+// the cluster's headless Service. It is fully qualified when a cluster domain
+// is given.
+func advertiseHost(etcdPeer etcdv1alpha1.EtcdPeer, clusterDomain string) string {
+	host := fmt.Sprintf(
+		"%s.%s.%s.svc",
+		etcdPeer.Name,
+		etcdPeer.Spec.ClusterName,
+		etcdPeer.Namespace,
+	)
+	return qualifyHost(host, clusterDomain)
+}
+
 // advertiseURL builds the canonical URL of this peer from it's name and the
 // cluster name.
-func advertiseURL(etcdPeer etcdv1alpha1.EtcdPeer) *url.URL {
+func advertiseURL(etcdPeer etcdv1alpha1.EtcdPeer, clusterDomain, scheme string, port int) *url.URL {
 	return &url.URL{
-		Scheme: "http",
-		Host: fmt.Sprintf(
-			"%s.%s.%s.svc:2380",
-			etcdPeer.Name,
-			etcdPeer.Namespace,
-			etcdPeer.Spec.ClusterName,
-		),
+		Scheme: scheme,
+		Host:   hostPort(advertiseHost(etcdPeer, clusterDomain), port),
+	}
+}
+
+// usesHostNetwork reports whether the peer's pod runs in its node's network
+// namespace.
+func usesHostNetwork(peer etcdv1alpha1.EtcdPeer) bool {
+	return peer.Spec.PodTemplate != nil && peer.Spec.PodTemplate.HostNetwork
+}
+
+// podAdvertiseURL builds the URL of this peer's pod. On the host network the
+// pod's DNS name doesn't reach etcd, so the IP address of the pod, which is
+// that of its node, is substituted by the kubelet instead.
+func podAdvertiseURL(peer etcdv1alpha1.EtcdPeer, clusterDomain, scheme string, port int) *url.URL {
+	if usesHostNetwork(peer) {
+		// JoinHostPort can't tell that the variable will hold an IPv6
+		// address.
+		host := fmt.Sprintf("$(%s):%d", podIPEnvVar, port)
+		if usesIPv6(peer) {
+			host = fmt.Sprintf("[$(%s)]:%d", podIPEnvVar, port)
+		}
+		return &url.URL{
+			Scheme: scheme,
+			Host:   host,
+		}
+	}
+	return advertiseURL(peer, clusterDomain, scheme, port)
+}
+
+// advertisedPeerURLs returns the value of `ETCD_INITIAL_ADVERTISE_PEER_URLS`,
+// which is the peer's own URL unless it has been overridden.
+func advertisedPeerURLs(peer etcdv1alpha1.EtcdPeer, clusterDomain string) string {
+	if peer.Spec.Advertise != nil && len(peer.Spec.Advertise.PeerURLs) > 0 {
+		return strings.Join(peer.Spec.Advertise.PeerURLs, ",")
+	}
+	return podAdvertiseURL(peer, clusterDomain, peer.PeerScheme(), etcdPeerPort).String()
+}
+
+// advertisedClientURLs returns the value of `ETCD_ADVERTISE_CLIENT_URLS`,
+// which is the peer's own URL unless it has been overridden.
+func advertisedClientURLs(peer etcdv1alpha1.EtcdPeer, clusterDomain string) string {
+	if peer.Spec.Advertise != nil && len(peer.Spec.Advertise.ClientURLs) > 0 {
+		return strings.Join(peer.Spec.Advertise.ClientURLs, ",")
+	}
+	return podAdvertiseURL(peer, clusterDomain, peer.ClientScheme(), etcdClientPort).String()
+}
+
+// listenURL builds the URL etcd binds to, on all interfaces of the peer's IP
+// family.
+func listenURL(peer etcdv1alpha1.EtcdPeer, scheme string, port int) *url.URL {
+	host := net.IPv4zero.String()
+	if usesIPv6(peer) {
+		host = net.IPv6zero.String()
+	}
+	return &url.URL{
+		Scheme: scheme,
+		Host:   hostPort(host, port),
+	}
+}
+
+// etcdEnv returns the environment variables used to configure the etcd
+// process of the peer.
+func etcdEnv(peer etcdv1alpha1.EtcdPeer, clusterDomain string) []corev1.EnvVar {
+	env := []corev1.EnvVar{
+		{
+			Name:  etcdInitialClusterEnvVar,
+			Value: staticBootstrapInitialCluster(*peer.Spec.Bootstrap.Static, peer.PeerScheme(), clusterDomain),
+		},
+		{
+			Name:  etcdNameEnvVar,
+			Value: peer.Name,
+		},
+		{
+			Name:  etcdDataDirEnvVar,
+			Value: dataMountPath,
+		},
+		{
+			Name:  etcdInitialAdvertisePeerURLsEnvVar,
+			Value: advertisedPeerURLs(peer, clusterDomain),
+		},
+		{
+			Name:  etcdListenPeerURLsEnvVar,
+			Value: listenURL(peer, peer.PeerScheme(), etcdPeerPort).String(),
+		},
+		{
+			Name:  etcdAdvertiseClientURLsEnvVar,
+			Value: advertisedClientURLs(peer, clusterDomain),
+		},
+		{
+			Name:  etcdListenClientURLsEnvVar,
+			Value: listenURL(peer, peer.ClientScheme(), etcdClientPort).String(),
+		},
+	}
+
+	if usesHostNetwork(peer) {
+		// This must come before the advertise URLs which refer to it.
+		env = append([]corev1.EnvVar{
+			{
+				Name: podIPEnvVar,
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"},
+				},
+			},
+		}, env...)
+	}
+
+	if peer.PeerTLSSecretName() != "" {
+		env = append(env,
+			corev1.EnvVar{Name: etcdPeerCertFileEnvVar, Value: path.Join(peerTLSMountPath, corev1.TLSCertKey)},
+			corev1.EnvVar{Name: etcdPeerKeyFileEnvVar, Value: path.Join(peerTLSMountPath, corev1.TLSPrivateKeyKey)},
+			corev1.EnvVar{Name: etcdPeerTrustedCAFileEnvVar, Value: path.Join(peerTLSMountPath, tlsCAKey)},
+			corev1.EnvVar{Name: etcdPeerClientCertAuthEnvVar, Value: "true"},
+		)
+	}
+	if peer.ServerTLSSecretName() != "" {
+		env = append(env,
+			corev1.EnvVar{Name: etcdCertFileEnvVar, Value: path.Join(serverTLSMountPath, corev1.TLSCertKey)},
+			corev1.EnvVar{Name: etcdKeyFileEnvVar, Value: path.Join(serverTLSMountPath, corev1.TLSPrivateKeyKey)},
+			corev1.EnvVar{Name: etcdTrustedCAFileEnvVar, Value: path.Join(serverTLSMountPath, tlsCAKey)},
+			corev1.EnvVar{Name: etcdClientCertAuthEnvVar, Value: "true"},
+		)
+	}
+
+	if options := peer.Spec.Etcd; options != nil {
+		if options.EnableV2 != nil {
+			env = append(env, corev1.EnvVar{
+				Name:  etcdEnableV2EnvVar,
+				Value: strconv.FormatBool(*options.EnableV2),
+			})
+		}
+		if options.QuotaBackendBytes != nil {
+			env = append(env, corev1.EnvVar{
+				Name:  etcdQuotaBackendBytesEnvVar,
+				Value: strconv.FormatInt(options.QuotaBackendBytes.Value(), 10),
+			})
+		}
+		// etcd takes both of these as a number of milliseconds.
+		if options.HeartbeatInterval != nil {
+			env = append(env, corev1.EnvVar{
+				Name:  etcdHeartbeatIntervalEnvVar,
+				Value: strconv.FormatInt(options.HeartbeatInterval.Milliseconds(), 10),
+			})
+		}
+		if options.ElectionTimeout != nil {
+			env = append(env, corev1.EnvVar{
+				Name:  etcdElectionTimeoutEnvVar,
+				Value: strconv.FormatInt(options.ElectionTimeout.Milliseconds(), 10),
+			})
+		}
+		if options.SnapshotCount != nil {
+			env = append(env, corev1.EnvVar{
+				Name:  etcdSnapshotCountEnvVar,
+				Value: strconv.FormatInt(*options.SnapshotCount, 10),
+			})
+		}
+		if options.MaxRequestBytes != nil {
+			env = append(env, corev1.EnvVar{
+				Name:  etcdMaxRequestBytesEnvVar,
+				Value: strconv.FormatInt(options.MaxRequestBytes.Value(), 10),
+			})
+		}
+
+		// The webhook rejects extra variables which would override ours,
+		// but it may not be deployed.
+		managed := make(map[string]bool, len(env))
+		for _, ev := range env {
+			managed[ev.Name] = true
+		}
+		for _, ev := range options.ExtraEnv {
+			if !managed[ev.Name] {
+				env = append(env, ev)
+			}
+		}
+	}
+
+	return env
+}
+
+// dataVolume returns the volume for etcd's data directory, and its mount for
+// the etcd container. Using a volume rather than the container's filesystem
+// keeps the data across container restarts, and lets the pod's `fsGroup`
+// make it writable when etcd doesn't run as root.
+func dataVolume() (corev1.Volume, corev1.VolumeMount) {
+	volume := corev1.Volume{
+		Name: dataVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
 	}
+	mount := corev1.VolumeMount{
+		Name:      dataVolumeName,
+		MountPath: dataMountPath,
+	}
+	return volume, mount
 }
 
-func defineReplicaSet(peer etcdv1alpha1.EtcdPeer) appsv1.ReplicaSet {
+// tlsVolumes returns the volumes, and the matching mounts for the etcd
+// container, holding the certificates named by the peer's TLS configuration.
+func tlsVolumes(peer etcdv1alpha1.EtcdPeer) ([]corev1.Volume, []corev1.VolumeMount) {
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	add := func(name, secretName, mountPath string) {
+		volumes = append(volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: secretName},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: mountPath,
+			ReadOnly:  true,
+		})
+	}
+	if secretName := peer.PeerTLSSecretName(); secretName != "" {
+		add(peerTLSVolumeName, secretName, peerTLSMountPath)
+	}
+	if secretName := peer.ServerTLSSecretName(); secretName != "" {
+		add(serverTLSVolumeName, secretName, serverTLSMountPath)
+	}
+	if secretName := peer.ClientTLSSecretName(); secretName != "" {
+		add(clientTLSVolumeName, secretName, clientTLSMountPath)
+	}
+	return volumes, mounts
+}
+
+// imageTag returns the tag or digest of an image reference, including its
+// leading separator, or an empty string if it has neither.
+func imageTag(image string) string {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		return image[i:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i:]
+	}
+	return ""
+}
+
+// etcdImage returns the etcd image for the peer. The peer may pull from a
+// different repository, but always runs the tag of the operator's image.
+func etcdImage(peer etcdv1alpha1.EtcdPeer, defaultImage string) string {
+	if peer.Spec.Image == nil || peer.Spec.Image.Repository == "" {
+		return defaultImage
+	}
+	return peer.Spec.Image.Repository + imageTag(defaultImage)
+}
+
+// podAffinity returns the affinity given on the peer's pod template. If there
+// isn't one, the pod prefers not to be scheduled on a node already running a
+// peer of the same cluster. This is only a preference so that small test
+// clusters still schedule on a single node.
+func podAffinity(peer etcdv1alpha1.EtcdPeer) *corev1.Affinity {
+	if peer.Spec.PodTemplate != nil && peer.Spec.PodTemplate.Affinity != nil {
+		return peer.Spec.PodTemplate.Affinity.DeepCopy()
+	}
+	return &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+				{
+					Weight: 100,
+					PodAffinityTerm: corev1.PodAffinityTerm{
+						LabelSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{
+								appLabel:     appName,
+								clusterLabel: peer.Spec.ClusterName,
+							},
+						},
+						TopologyKey: corev1.LabelHostname,
+					},
+				},
+			},
+		},
+	}
+}
+
+func defineReplicaSet(peer etcdv1alpha1.EtcdPeer, image, clusterDomain string) appsv1.ReplicaSet {
 	var replicas int32 = 1
+	dataVolume, dataVolumeMount := dataVolume()
+	tlsVolumes, tlsVolumeMounts := tlsVolumes(peer)
+	volumes := append([]corev1.Volume{dataVolume}, tlsVolumes...)
+	volumeMounts := append([]corev1.VolumeMount{dataVolumeMount}, tlsVolumeMounts...)
+	livenessProbe, readinessProbe := etcdProbes(peer)
+
+	var pullPolicy corev1.PullPolicy
+	var pullSecrets []corev1.LocalObjectReference
+	if peer.Spec.Image != nil {
+		pullPolicy = peer.Spec.Image.PullPolicy
+		pullSecrets = peer.Spec.Image.PullSecrets
+	}
+
+	var nodeSelector map[string]string
+	var tolerations []corev1.Toleration
+	var priorityClassName string
+	var serviceAccountName, schedulerName string
+	var runtimeClassName *string
+	var ports []corev1.ContainerPort
+	hostNetwork := usesHostNetwork(peer)
+	dnsPolicy := corev1.DNSClusterFirst
+	if hostNetwork {
+		// Cluster DNS is still needed to find the other peers.
+		dnsPolicy = corev1.DNSClusterFirstWithHostNet
+		// Declaring the host ports stops two peers being scheduled on the
+		// same node, where they would clash.
+		ports = []corev1.ContainerPort{
+			{Name: "client", ContainerPort: etcdClientPort, HostPort: etcdClientPort, Protocol: corev1.ProtocolTCP},
+			{Name: "peer", ContainerPort: etcdPeerPort, HostPort: etcdPeerPort, Protocol: corev1.ProtocolTCP},
+		}
+	}
+	var podSecurityContext *corev1.PodSecurityContext
+	var containerSecurityContext *corev1.SecurityContext
+	var resources corev1.ResourceRequirements
+	var initContainers []corev1.Container
+	var additionalContainers []corev1.Container
+	if template := peer.Spec.PodTemplate; template != nil {
+		nodeSelector = template.NodeSelector
+		tolerations = template.Tolerations
+		priorityClassName = template.PriorityClassName
+		serviceAccountName = template.ServiceAccountName
+		schedulerName = template.SchedulerName
+		runtimeClassName = template.RuntimeClassName
+		podSecurityContext = template.SecurityContext
+		containerSecurityContext = template.ContainerSecurityContext
+		if template.Resources != nil {
+			resources = *template.Resources
+		}
+		initContainers = template.InitContainers
+		additionalContainers = template.AdditionalContainers
+		// The webhook stops these from using the operator's volume names
+		// and mount paths, so they can simply be added.
+		volumes = append(volumes, template.Volumes...)
+		volumeMounts = append(volumeMounts, template.VolumeMounts...)
+	}
+
+	// The etcd image only sets a default command, which arguments given
+	// without a command would replace.
+	var command, args []string
+	if peer.Spec.Etcd != nil && len(peer.Spec.Etcd.ExtraArgs) > 0 {
+		command = []string{etcdBinary}
+		args = peer.Spec.Etcd.ExtraArgs
+	}
+
+	containers := append([]corev1.Container{
+		{
+			Name:            etcdv1alpha1.EtcdContainerName,
+			Image:           etcdImage(peer, image),
+			ImagePullPolicy: pullPolicy,
+			Command:         command,
+			Args:            args,
+			Ports:           ports,
+			Env:             etcdEnv(peer, clusterDomain),
+			Resources:       resources,
+			VolumeMounts:    volumeMounts,
+			LivenessProbe:   livenessProbe,
+			ReadinessProbe:  readinessProbe,
+			SecurityContext: containerSecurityContext,
+		},
+	}, additionalContainers...)
 
 	// We use the same labels for the replica set itself, the selector on
 	// the replica set, and the pod template under the replica set.
@@ -86,7 +569,7 @@ func defineReplicaSet(peer etcdv1alpha1.EtcdPeer) appsv1.ReplicaSet {
 		peerLabel:    peer.Name,
 	}
 
-	return appsv1.ReplicaSet{
+	replicaSet := appsv1.ReplicaSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels:          labels,
 			Annotations:     make(map[string]string),
@@ -106,48 +589,176 @@ func defineReplicaSet(peer etcdv1alpha1.EtcdPeer) appsv1.ReplicaSet {
 					Namespace:   peer.Namespace,
 				},
 				Spec: corev1.PodSpec{
-					Hostname:  peer.Name,
-					Subdomain: peer.Spec.ClusterName,
-					Containers: []corev1.Container{
-						{
-							Name:  appName,
-							Image: etcdImage,
-							Env: []corev1.EnvVar{
-								{
-									Name:  etcdInitialClusterEnvVar,
-									Value: staticBootstrapInitialCluster(*peer.Spec.Bootstrap.Static),
-								},
-								{
-									Name:  etcdNameEnvVar,
-									Value: peer.Name,
-								},
-								{
-									Name:  etcdAdvertiseClientURLsEnvVar,
-									Value: advertiseURL(peer).String(),
-								},
-							},
-						},
-					},
+					Hostname:           peer.Name,
+					Subdomain:          peer.Spec.ClusterName,
+					Containers:         containers,
+					InitContainers:     initContainers,
+					Volumes:            volumes,
+					ImagePullSecrets:   pullSecrets,
+					Affinity:           podAffinity(peer),
+					NodeSelector:       nodeSelector,
+					Tolerations:        tolerations,
+					PriorityClassName:  priorityClassName,
+					SecurityContext:    podSecurityContext,
+					ServiceAccountName: serviceAccountName,
+					SchedulerName:      schedulerName,
+					RuntimeClassName:   runtimeClassName,
+					HostNetwork:        hostNetwork,
+					DNSPolicy:          dnsPolicy,
 				},
 			},
 		},
 	}
+
+	hash := podTemplateHash(replicaSet.Spec.Template)
+	replicaSet.Annotations[podTemplateHashAnnotation] = hash
+	// The initial cluster always encodes.
+	initialCluster, _ := json.Marshal(peer.Spec.Bootstrap.Static.InitialCluster)
+	replicaSet.Annotations[initialClusterAnnotation] = string(initialCluster)
+	replicaSet.Spec.Template.Annotations[podTemplateHashAnnotation] = hash
+	return replicaSet
+}
+
+// podTemplateHash returns a short hash of the pod template, which identifies
+// the version of the EtcdPeer spec that it was defined from.
+func podTemplateHash(template corev1.PodTemplateSpec) string {
+	hasher := fnv.New32a()
+	// A template built by defineReplicaSet always encodes.
+	encoded, _ := json.Marshal(template)
+	_, _ = hasher.Write(encoded)
+	return rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+// etcdContainerEnvVar returns the value of the named environment variable on
+// the etcd container of the replica set, or an empty string if it is not set.
+func etcdContainerEnvVar(replicaSet appsv1.ReplicaSet, name string) string {
+	for _, container := range replicaSet.Spec.Template.Spec.Containers {
+		if container.Name != etcdv1alpha1.EtcdContainerName {
+			continue
+		}
+		for _, ev := range container.Env {
+			if ev.Name == name {
+				return ev.Value
+			}
+		}
+	}
+	return ""
+}
+
+// replicaSetPeer rebuilds the fields of the peer that the replica set was
+// defined from which may not be changed afterwards. Replica sets defined
+// before the initial cluster was recorded in an annotation only have the
+// cluster name.
+func replicaSetPeer(replicaSet appsv1.ReplicaSet) (etcdv1alpha1.EtcdPeer, bool) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: replicaSet.Name, Namespace: replicaSet.Namespace},
+		Spec:       etcdv1alpha1.EtcdPeerSpec{ClusterName: replicaSet.Labels[clusterLabel]},
+	}
+	encoded, ok := replicaSet.Annotations[initialClusterAnnotation]
+	if !ok {
+		return peer, false
+	}
+	var initialCluster []etcdv1alpha1.InitialClusterMember
+	if err := json.Unmarshal([]byte(encoded), &initialCluster); err != nil {
+		return peer, false
+	}
+	peer.Spec.Bootstrap = &etcdv1alpha1.Bootstrap{
+		Static: &etcdv1alpha1.StaticBootstrap{InitialCluster: initialCluster},
+	}
+	return peer, true
+}
+
+// validateReplicaSetIdentity checks that an existing replica set was defined
+// from the same cluster name and bootstrap configuration that the peer has
+// now, using the same checks as the validating webhook. For replica sets
+// which don't record their initial cluster, the `ETCD_INITIAL_CLUSTER` of
+// the etcd container is compared instead, accepting one defined before hosts
+// in the Service domain were qualified.
+func validateReplicaSetIdentity(peer etcdv1alpha1.EtcdPeer, replicaSet appsv1.ReplicaSet, clusterDomain string) error {
+	old, recorded := replicaSetPeer(replicaSet)
+	if !recorded {
+		old.Spec.Bootstrap = peer.Spec.Bootstrap
+	}
+	allErrs := peer.ValidateImmutableFields(&old)
+	if !recorded {
+		actual := etcdContainerEnvVar(replicaSet, etcdInitialClusterEnvVar)
+		static := *peer.Spec.Bootstrap.Static
+		expected := staticBootstrapInitialCluster(static, peer.PeerScheme(), clusterDomain)
+		if actual != expected && actual != staticBootstrapInitialCluster(static, peer.PeerScheme(), "") {
+			allErrs = append(allErrs, field.Forbidden(
+				field.NewPath("spec", "bootstrap", "static", "initialCluster"),
+				fmt.Sprintf("changed from %q to %q", actual, expected),
+			))
+		}
+	}
+	return allErrs.ToAggregate()
 }
 
 func (r *EtcdPeerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), r.ReconcileTimeout)
 	defer cancel()
 
 	log := r.Log.WithValues("etcdpeer", req.NamespacedName)
 
+	result, err := r.reconcilePeer(ctx, log, req)
+	if err != nil && isTransient(err) {
+		delay := r.backoff.Next(req.NamespacedName)
+		log.Info("Transient error, retrying later", "error", err.Error(), "retryAfter", delay)
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	if err == nil {
+		r.backoff.Reset(req.NamespacedName)
+	}
+	return result, err
+}
+
+func (r *EtcdPeerReconciler) reconcilePeer(ctx context.Context, log logr.Logger, req ctrl.Request) (ctrl.Result, error) {
 	var peer etcdv1alpha1.EtcdPeer
 	if err := r.Get(ctx, req.NamespacedName, &peer); err != nil {
+		if apierrs.IsNotFound(err) {
+			clusterLeaders.forget(req.NamespacedName)
+		}
 		log.Error(err, "unable to fetch EtcdPeer")
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
 	log.V(2).Info("Found EtcdPeer", "name", peer.Name)
 
+	// The validating webhook requires a static bootstrap configuration, but
+	// it may not be deployed. Nothing can be run for the peer without one,
+	// and retrying won't help until its spec is changed.
+	if peer.Spec.Bootstrap == nil || peer.Spec.Bootstrap.Static == nil {
+		log.Info("EtcdPeer has no static bootstrap configuration, ignoring it until it is given one")
+		r.Recorder.Event(&peer, corev1.EventTypeWarning, eventReasonInvalidSpec,
+			"spec.bootstrap.static is required, nothing will be run for the peer until it is set")
+		return ctrl.Result{}, nil
+	}
+
+	if isPaused(peer) {
+		log.V(1).Info("Reconciliation is paused, only updating status")
+		if err := r.updatePeerStatus(ctx, log, peer); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: statusRefreshInterval}, nil
+	}
+
+	if peer.Spec.TLS != nil && peer.Spec.TLS.IssuerRef != nil {
+		ready, err := r.reconcileCertificates(ctx, log, peer)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !ready {
+			log.V(1).Info("Waiting for certificates to be issued")
+			return ctrl.Result{RequeueAfter: certificateRequeueInterval}, nil
+		}
+	}
+
+	if peer.Spec.NetworkPolicy != nil {
+		if err := r.reconcileNetworkPolicy(ctx, log, peer); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
 	var existingReplicaSet appsv1.ReplicaSet
 	err := r.Get(
 		ctx,
@@ -160,12 +771,16 @@ func (r *EtcdPeerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	if apierrs.IsNotFound(err) {
 		log.V(1).Info("Replica set does not exist, creating")
-		replicaSet := defineReplicaSet(peer)
+		replicaSet := defineReplicaSet(peer, r.EtcdImage, r.ClusterDomain)
 
 		if err := r.Create(ctx, &replicaSet); err != nil {
 			log.Error(err, "unable to create ReplicaSet for EtcdPeer", "replicaSet", replicaSet)
+			r.Recorder.Eventf(&peer, corev1.EventTypeWarning, eventReasonCreateFailed,
+				"Failed to create ReplicaSet %s: %s", replicaSet.Name, err)
 			return ctrl.Result{}, err
 		}
+		r.Recorder.Eventf(&peer, corev1.EventTypeNormal, eventReasonReplicaSetCreated,
+			"Created ReplicaSet %s", replicaSet.Name)
 		return ctrl.Result{}, nil
 	}
 
@@ -177,9 +792,133 @@ func (r *EtcdPeerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	log.V(2).Info("Replica set already exists")
 
-	// TODO Additional logic here
+	// The validating webhook should stop these fields changing, but it may not
+	// be deployed. Don't act on a peer which no longer matches the pod that
+	// was created for it.
+	if err := validateReplicaSetIdentity(peer, existingReplicaSet, r.ClusterDomain); err != nil {
+		log.Error(err, "EtcdPeer no longer matches its ReplicaSet, it must be deleted and recreated")
+		r.Recorder.Eventf(&peer, corev1.EventTypeWarning, eventReasonIdentityChanged,
+			"EtcdPeer no longer matches ReplicaSet %s and must be deleted and recreated: %s", existingReplicaSet.Name, err)
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.updateReplicaSet(ctx, log, peer, existingReplicaSet); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.replaceOutdatedPod(ctx, log, peer); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.updatePeerStatus(ctx, log, peer); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.reconcileStaleMembers(ctx, log, peer); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// The member's health can change without any change to the resources we
+	// watch, so check on it again later.
+	return ctrl.Result{RequeueAfter: statusRefreshInterval}, nil
+}
 
-	return ctrl.Result{}, nil
+// isPaused reports whether the operator has been asked to leave the peer's
+// resources alone.
+func isPaused(peer etcdv1alpha1.EtcdPeer) bool {
+	return peer.Annotations[etcdv1alpha1.PausedAnnotation] == "true"
+}
+
+// setFieldsDiffer reports whether any field set in `desired` has a different
+// value in `actual`. Both are the unstructured form of an object, or of part of
+// one. Fields which are only in `actual`, such as those defaulted by the API
+// server, are ignored. Lists must be the same length, and their items are
+// compared in the same way.
+func setFieldsDiffer(desired, actual interface{}) bool {
+	switch desired := desired.(type) {
+	case nil:
+		return false
+	case map[string]interface{}:
+		actual, _ := actual.(map[string]interface{})
+		for key, value := range desired {
+			if setFieldsDiffer(value, actual[key]) {
+				return true
+			}
+		}
+		return false
+	case []interface{}:
+		actual, _ := actual.([]interface{})
+		if len(actual) != len(desired) {
+			return true
+		}
+		for i := range desired {
+			if setFieldsDiffer(desired[i], actual[i]) {
+				return true
+			}
+		}
+		return false
+	default:
+		return !apiequality.Semantic.DeepEqual(desired, actual)
+	}
+}
+
+// replicaSetDrifted reports whether the replica count, annotations or pod
+// template set by defineReplicaSet differ on the existing ReplicaSet. Fields
+// which were defaulted, or set by someone else, are ignored.
+func replicaSetDrifted(existing, desired appsv1.ReplicaSet) bool {
+	if !apiequality.Semantic.DeepEqual(existing.Spec.Replicas, desired.Spec.Replicas) {
+		return true
+	}
+	for key, value := range desired.Annotations {
+		if existing.Annotations[key] != value {
+			return true
+		}
+	}
+	return podTemplateDrifted(existing.Spec.Template, desired.Spec.Template)
+}
+
+// podTemplateDrifted reports whether any field set in the desired pod template
+// differs in the existing one.
+func podTemplateDrifted(existing, desired corev1.PodTemplateSpec) bool {
+	existingTemplate, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&existing)
+	if err != nil {
+		return true
+	}
+	desiredTemplate, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&desired)
+	if err != nil {
+		return true
+	}
+	return setFieldsDiffer(desiredTemplate, existingTemplate)
+}
+
+// updateReplicaSet brings the peer's ReplicaSet back to what its spec defines,
+// whether the spec has changed or the ReplicaSet was edited by someone else.
+// The running pod is replaced separately, by replaceOutdatedPod, once the rest
+// of the cluster can do without it.
+func (r *EtcdPeerReconciler) updateReplicaSet(ctx context.Context, log logr.Logger, peer etcdv1alpha1.EtcdPeer, replicaSet appsv1.ReplicaSet) error {
+	desired := defineReplicaSet(peer, r.EtcdImage, r.ClusterDomain)
+	if !replicaSetDrifted(replicaSet, desired) {
+		return nil
+	}
+
+	log.V(1).Info("ReplicaSet has drifted from its EtcdPeer, updating it",
+		"podTemplateHash", desired.Annotations[podTemplateHashAnnotation])
+	patch := client.MergeFrom(replicaSet.DeepCopy())
+	replicaSet.Spec.Replicas = desired.Spec.Replicas
+	replicaSet.Spec.Template = desired.Spec.Template
+	if replicaSet.Annotations == nil {
+		replicaSet.Annotations = make(map[string]string)
+	}
+	for key, value := range desired.Annotations {
+		replicaSet.Annotations[key] = value
+	}
+	if err := r.Patch(ctx, &replicaSet, patch); err != nil {
+		log.Error(err, "unable to update ReplicaSet for EtcdPeer", "replicaSet", replicaSet.Name)
+		return err
+	}
+	r.Recorder.Eventf(&peer, corev1.EventTypeNormal, eventReasonReplicaSetUpdated,
+		"Updated ReplicaSet %s to match the EtcdPeer", replicaSet.Name)
+	return nil
 }
 
 func (r *EtcdPeerReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -187,5 +926,10 @@ func (r *EtcdPeerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		For(&etcdv1alpha1.EtcdPeer{}).
 		// Watch for changes to ReplicaSet resources that an EtcdPeer owns.
 		Owns(&appsv1.ReplicaSet{}).
+		// Watch the pods run by those ReplicaSets to keep the status fresh.
+		Watches(
+			&source.Kind{Type: &corev1.Pod{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: podToPeerRequest},
+		).
 		Complete(r)
 }
@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"context"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -8,8 +10,16 @@ import (
 	"github.com/stretchr/testify/require"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
 	"github.com/improbable-eng/etcd-cluster-operator/internal/test/try"
@@ -85,9 +95,874 @@ func (s *controllerSuite) testPeerController(t *testing.T) {
 		}
 		require.NotNil(t, etcdInitialClusterEnvVar, "ETCD_INITIAL_CLUSTER environment variable unset")
 		require.Equal(t,
-			"bees=http://bees.my-cluster.default.svc:2380,magic=http://magic.my-cluster.default.svc:2380",
+			"bees=http://bees.my-cluster.default.svc.cluster.local:2380,magic=http://magic.my-cluster.default.svc.cluster.local:2380",
 			etcdInitialClusterEnvVar.Value,
 			"ETCD_INITIAL_CLUSTER environment variable set incorrectly",
 		)
+
+		// The creation should be visible as an Event on the EtcdPeer.
+		err = try.Eventually(func() error {
+			events := &corev1.EventList{}
+			if err := s.k8sClient.List(s.ctx, events, client.InNamespace(etcdPeer.Namespace)); err != nil {
+				return err
+			}
+			for _, event := range events.Items {
+				if event.InvolvedObject.Name == etcdPeer.Name && event.Reason == "ReplicaSetCreated" {
+					return nil
+				}
+			}
+			return fmt.Errorf("no ReplicaSetCreated event for EtcdPeer %s", etcdPeer.Name)
+		}, time.Second*5, time.Millisecond*500)
+		require.NoError(t, err)
+	})
+	t.Run("TestPeerController_WithTLS_UsesHTTPSAndMountsCertificates", func(t *testing.T) {
+		teardownFunc := s.setupTest(t)
+		defer teardownFunc()
+
+		etcdPeer := &etcdv1alpha1.EtcdPeer{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "secure",
+				Namespace: "default",
+			},
+			Spec: etcdv1alpha1.EtcdPeerSpec{
+				ClusterName: "my-cluster",
+				Bootstrap: &etcdv1alpha1.Bootstrap{
+					Static: &etcdv1alpha1.StaticBootstrap{
+						InitialCluster: []etcdv1alpha1.InitialClusterMember{
+							{
+								Name: "secure",
+								Host: "secure.my-cluster.default.svc",
+							},
+						},
+					},
+				},
+				TLS: &etcdv1alpha1.TLS{
+					PeerSecretName:   "my-cluster-peer-tls",
+					ServerSecretName: "my-cluster-server-tls",
+					ClientSecretName: "my-cluster-client-tls",
+				},
+			},
+		}
+
+		err := s.k8sClient.Create(s.ctx, etcdPeer)
+		require.NoError(t, err, "failed to create EtcdPeer resource")
+
+		replicaSet := &appsv1.ReplicaSet{}
+		err = try.Eventually(func() error {
+			return s.k8sClient.Get(s.ctx, client.ObjectKey{
+				Name:      etcdPeer.Name,
+				Namespace: etcdPeer.Namespace,
+			}, replicaSet)
+		}, time.Second*5, time.Millisecond*500)
+		require.NoError(t, err)
+
+		env := map[string]string{}
+		var mounts []string
+		for _, container := range replicaSet.Spec.Template.Spec.Containers {
+			if container.Name == "etcd" {
+				for _, ev := range container.Env {
+					env[ev.Name] = ev.Value
+				}
+				for _, mount := range container.VolumeMounts {
+					mounts = append(mounts, mount.MountPath)
+				}
+			}
+		}
+		require.Equal(t, "secure=https://secure.my-cluster.default.svc.cluster.local:2380", env["ETCD_INITIAL_CLUSTER"])
+		require.Equal(t, "https://secure.my-cluster.default.svc.cluster.local:2380", env["ETCD_INITIAL_ADVERTISE_PEER_URLS"])
+		require.Equal(t, "https://0.0.0.0:2380", env["ETCD_LISTEN_PEER_URLS"])
+		require.Equal(t, "https://0.0.0.0:2379", env["ETCD_LISTEN_CLIENT_URLS"])
+		require.Equal(t, "/etc/etcd/tls/server/tls.crt", env["ETCD_CERT_FILE"])
+		require.Equal(t, "/etc/etcd/tls/peer/ca.crt", env["ETCD_PEER_TRUSTED_CA_FILE"])
+		require.ElementsMatch(t, []string{"/var/lib/etcd", "/etc/etcd/tls/peer", "/etc/etcd/tls/server", "/etc/etcd/tls/client"}, mounts)
+
+		var secrets []string
+		for _, volume := range replicaSet.Spec.Template.Spec.Volumes {
+			if volume.Name == "etcd-data" {
+				require.NotNil(t, volume.EmptyDir, "data volume is not an emptyDir")
+				continue
+			}
+			require.NotNil(t, volume.Secret, "TLS volume is not a Secret")
+			secrets = append(secrets, volume.Secret.SecretName)
+		}
+		require.ElementsMatch(t, []string{"my-cluster-peer-tls", "my-cluster-server-tls", "my-cluster-client-tls"}, secrets)
+	})
+	t.Run("TestPeerController_WithoutPod_ReportsNotReady", func(t *testing.T) {
+		teardownFunc := s.setupTest(t)
+		defer teardownFunc()
+
+		etcdPeer := &etcdv1alpha1.EtcdPeer{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "lonely",
+				Namespace: "default",
+			},
+			Spec: etcdv1alpha1.EtcdPeerSpec{
+				ClusterName: "my-cluster",
+				Bootstrap: &etcdv1alpha1.Bootstrap{
+					Static: &etcdv1alpha1.StaticBootstrap{
+						InitialCluster: []etcdv1alpha1.InitialClusterMember{
+							{
+								Name: "lonely",
+								Host: "lonely.my-cluster.default.svc",
+							},
+						},
+					},
+				},
+			},
+		}
+
+		err := s.k8sClient.Create(s.ctx, etcdPeer)
+		require.NoError(t, err, "failed to create EtcdPeer resource")
+
+		// There is no kubelet or ReplicaSet controller in the test
+		// environment, so the pod will never appear.
+		err = try.Eventually(func() error {
+			if err := s.k8sClient.Get(s.ctx, client.ObjectKey{
+				Name:      etcdPeer.Name,
+				Namespace: etcdPeer.Namespace,
+			}, etcdPeer); err != nil {
+				return err
+			}
+			if len(etcdPeer.Status.Conditions) == 0 {
+				return fmt.Errorf("EtcdPeer has no conditions yet")
+			}
+			return nil
+		}, time.Second*5, time.Millisecond*500)
+		require.NoError(t, err)
+
+		condition := etcdPeer.Status.Conditions[0]
+		require.Equal(t, etcdv1alpha1.EtcdPeerReady, condition.Type)
+		require.Equal(t, corev1.ConditionFalse, condition.Status)
+		require.Equal(t, "PodNotFound", condition.Reason)
+	})
+	t.Run("TestPeerController_WhenPaused_DoesNotCreateReplicaSet", func(t *testing.T) {
+		teardownFunc := s.setupTest(t)
+		defer teardownFunc()
+
+		etcdPeer := &etcdv1alpha1.EtcdPeer{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "paused",
+				Namespace:   "default",
+				Annotations: map[string]string{"etcd.improbable.io/paused": "true"},
+			},
+			Spec: etcdv1alpha1.EtcdPeerSpec{
+				ClusterName: "my-cluster",
+				Bootstrap: &etcdv1alpha1.Bootstrap{
+					Static: &etcdv1alpha1.StaticBootstrap{
+						InitialCluster: []etcdv1alpha1.InitialClusterMember{
+							{
+								Name: "paused",
+								Host: "paused.my-cluster.default.svc",
+							},
+						},
+					},
+				},
+			},
+		}
+
+		err := s.k8sClient.Create(s.ctx, etcdPeer)
+		require.NoError(t, err, "failed to create EtcdPeer resource")
+
+		// The status is still observed while paused.
+		err = try.Eventually(func() error {
+			if err := s.k8sClient.Get(s.ctx, client.ObjectKey{
+				Name:      etcdPeer.Name,
+				Namespace: etcdPeer.Namespace,
+			}, etcdPeer); err != nil {
+				return err
+			}
+			if len(etcdPeer.Status.Conditions) == 0 {
+				return fmt.Errorf("EtcdPeer has no conditions yet")
+			}
+			return nil
+		}, time.Second*5, time.Millisecond*500)
+		require.NoError(t, err)
+
+		replicaSet := &appsv1.ReplicaSet{}
+		err = s.k8sClient.Get(s.ctx, client.ObjectKey{
+			Name:      etcdPeer.Name,
+			Namespace: etcdPeer.Namespace,
+		}, replicaSet)
+		require.True(t, apierrs.IsNotFound(err), "expected no ReplicaSet, got %v", err)
+	})
+	t.Run("TestPeerController_WhenSpecChanges_UpdatesReplicaSetTemplate", func(t *testing.T) {
+		teardownFunc := s.setupTest(t)
+		defer teardownFunc()
+
+		etcdPeer := &etcdv1alpha1.EtcdPeer{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "changeable",
+				Namespace: "default",
+			},
+			Spec: etcdv1alpha1.EtcdPeerSpec{
+				ClusterName: "my-cluster",
+				Bootstrap: &etcdv1alpha1.Bootstrap{
+					Static: &etcdv1alpha1.StaticBootstrap{
+						InitialCluster: []etcdv1alpha1.InitialClusterMember{
+							{
+								Name: "changeable",
+								Host: "changeable.my-cluster.default.svc",
+							},
+						},
+					},
+				},
+			},
+		}
+
+		err := s.k8sClient.Create(s.ctx, etcdPeer)
+		require.NoError(t, err, "failed to create EtcdPeer resource")
+
+		replicaSet := &appsv1.ReplicaSet{}
+		err = try.Eventually(func() error {
+			return s.k8sClient.Get(s.ctx, client.ObjectKey{
+				Name:      etcdPeer.Name,
+				Namespace: etcdPeer.Namespace,
+			}, replicaSet)
+		}, time.Second*5, time.Millisecond*500)
+		require.NoError(t, err)
+		originalHash := replicaSet.Annotations["etcd.improbable.io/pod-template-hash"]
+		require.NotEmpty(t, originalHash)
+
+		etcdPeer.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{
+			NodeSelector: map[string]string{"dedicated": "etcd"},
+		}
+		err = s.k8sClient.Update(s.ctx, etcdPeer)
+		require.NoError(t, err, "failed to update EtcdPeer resource")
+
+		err = try.Eventually(func() error {
+			if err := s.k8sClient.Get(s.ctx, client.ObjectKey{
+				Name:      etcdPeer.Name,
+				Namespace: etcdPeer.Namespace,
+			}, replicaSet); err != nil {
+				return err
+			}
+			if replicaSet.Annotations["etcd.improbable.io/pod-template-hash"] == originalHash {
+				return fmt.Errorf("ReplicaSet pod template has not been updated")
+			}
+			return nil
+		}, time.Second*5, time.Millisecond*500)
+		require.NoError(t, err)
+		require.Equal(t, "etcd", replicaSet.Spec.Template.Spec.NodeSelector["dedicated"])
+	})
+}
+
+func TestPodAffinity_WithoutTemplate_PrefersSpreadingPeers(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		Spec: etcdv1alpha1.EtcdPeerSpec{ClusterName: "my-cluster"},
+	}
+
+	affinity := podAffinity(peer)
+	require.NotNil(t, affinity.PodAntiAffinity)
+	terms := affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	require.Len(t, terms, 1)
+	require.Equal(t, "kubernetes.io/hostname", terms[0].PodAffinityTerm.TopologyKey)
+	require.Equal(t, "my-cluster", terms[0].PodAffinityTerm.LabelSelector.MatchLabels["etcd.improbable.io/cluster-name"])
+}
+
+func TestPodAffinity_WithTemplateAffinity_ReplacesDefault(t *testing.T) {
+	affinity := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{
+						MatchExpressions: []corev1.NodeSelectorRequirement{
+							{Key: "dedicated", Operator: corev1.NodeSelectorOpIn, Values: []string{"etcd"}},
+						},
+					},
+				},
+			},
+		},
+	}
+	peer := etcdv1alpha1.EtcdPeer{
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{Affinity: affinity},
+		},
+	}
+
+	require.Equal(t, affinity, podAffinity(peer))
+}
+
+func TestDefineReplicaSet_WithTolerationsAndPriority_SetsPodSpec(t *testing.T) {
+	tolerations := []corev1.Toleration{
+		{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "etcd", Effect: corev1.TaintEffectNoSchedule},
+	}
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				Tolerations:       tolerations,
+				PriorityClassName: "etcd-critical",
+			},
+		},
+	}
+
+	podSpec := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local").Spec.Template.Spec
+	require.Equal(t, tolerations, podSpec.Tolerations)
+	require.Equal(t, "etcd-critical", podSpec.PriorityClassName)
+}
+
+func TestDefineReplicaSet_WithServiceAccountSchedulerAndRuntime_SetsPodSpec(t *testing.T) {
+	runtimeClass := "gvisor"
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				ServiceAccountName: "etcd-backup",
+				SchedulerName:      "etcd-scheduler",
+				RuntimeClassName:   &runtimeClass,
+			},
+		},
+	}
+
+	podSpec := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local").Spec.Template.Spec
+	require.Equal(t, "etcd-backup", podSpec.ServiceAccountName)
+	require.Equal(t, "etcd-scheduler", podSpec.SchedulerName)
+	require.Equal(t, &runtimeClass, podSpec.RuntimeClassName)
+}
+
+func TestDefineReplicaSet_WithResources_SetsEtcdContainerResources(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				Resources: &corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+					Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+				},
+			},
+		},
+	}
+
+	container := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local").Spec.Template.Spec.Containers[0]
+	require.Equal(t, "500m", container.Resources.Requests.Cpu().String())
+	require.Equal(t, "2Gi", container.Resources.Limits.Memory().String())
+}
+
+func TestDefineReplicaSet_WithNonRootSecurityContext_MountsWritableDataDir(t *testing.T) {
+	user, group := int64(1000), int64(1000)
+	nonRoot := true
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				SecurityContext: &corev1.PodSecurityContext{
+					RunAsUser:    &user,
+					RunAsNonRoot: &nonRoot,
+					FSGroup:      &group,
+				},
+				ContainerSecurityContext: &corev1.SecurityContext{
+					Capabilities: &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				},
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	podSpec := replicaSet.Spec.Template.Spec
+	require.Equal(t, &group, podSpec.SecurityContext.FSGroup)
+	require.Equal(t, []corev1.Capability{"ALL"}, podSpec.Containers[0].SecurityContext.Capabilities.Drop)
+
+	require.Equal(t, "/var/lib/etcd", etcdContainerEnvVar(replicaSet, "ETCD_DATA_DIR"))
+	require.Contains(t, podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "etcd-data", MountPath: "/var/lib/etcd"})
+}
+
+func TestDefineReplicaSet_WithExtraVolumesAndInitContainers_KeepsOperatorVolumes(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				Volumes: []corev1.Volume{
+					{Name: "ca-bundle", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "ca-bundle", MountPath: "/etc/ssl/certs"},
+				},
+				InitContainers: []corev1.Container{
+					{Name: "prepare", Image: "busybox"},
+				},
+			},
+		},
+	}
+
+	podSpec := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local").Spec.Template.Spec
+	var volumeNames, mountPaths []string
+	for _, volume := range podSpec.Volumes {
+		volumeNames = append(volumeNames, volume.Name)
+	}
+	for _, mount := range podSpec.Containers[0].VolumeMounts {
+		mountPaths = append(mountPaths, mount.MountPath)
+	}
+	require.ElementsMatch(t, []string{"etcd-data", "ca-bundle"}, volumeNames)
+	require.ElementsMatch(t, []string{"/var/lib/etcd", "/etc/ssl/certs"}, mountPaths)
+	require.Len(t, podSpec.InitContainers, 1)
+	require.Equal(t, "prepare", podSpec.InitContainers[0].Name)
+}
+
+func TestDefineReplicaSet_WithAdditionalContainers_KeepsEtcdContainer(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				AdditionalContainers: []corev1.Container{
+					{Name: "log-shipper", Image: "fluent-bit"},
+				},
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	containers := replicaSet.Spec.Template.Spec.Containers
+	require.Len(t, containers, 2)
+	require.Equal(t, "etcd", containers[0].Name)
+	require.Equal(t, "log-shipper", containers[1].Name)
+	require.Equal(t, "bees", etcdContainerEnvVar(replicaSet, "ETCD_NAME"))
+}
+
+func TestDefineReplicaSet_WithExtraEnvAndArgs_PassesThemToEtcd(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+			Etcd: &etcdv1alpha1.EtcdOptions{
+				ExtraEnv: []corev1.EnvVar{
+					{Name: "ETCD_AUTO_COMPACTION_RETENTION", Value: "1"},
+					{Name: "ETCD_NAME", Value: "not-bees"},
+				},
+				ExtraArgs: []string{"--max-txn-ops=256"},
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	container := replicaSet.Spec.Template.Spec.Containers[0]
+	require.Equal(t, []string{"/usr/local/bin/etcd"}, container.Command)
+	require.Equal(t, []string{"--max-txn-ops=256"}, container.Args)
+	require.Equal(t, "1", etcdContainerEnvVar(replicaSet, "ETCD_AUTO_COMPACTION_RETENTION"))
+	// Operator managed variables can't be overridden, even without the webhook.
+	require.Equal(t, "bees", etcdContainerEnvVar(replicaSet, "ETCD_NAME"))
+}
+
+func TestDefineReplicaSet_WithSnapshotCountAndMaxRequestBytes_SetsEnv(t *testing.T) {
+	var snapshotCount int64 = 10000
+	maxRequestBytes := resource.MustParse("4Mi")
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+			Etcd: &etcdv1alpha1.EtcdOptions{
+				SnapshotCount:   &snapshotCount,
+				MaxRequestBytes: &maxRequestBytes,
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	require.Equal(t, "10000", etcdContainerEnvVar(replicaSet, "ETCD_SNAPSHOT_COUNT"))
+	require.Equal(t, "4194304", etcdContainerEnvVar(replicaSet, "ETCD_MAX_REQUEST_BYTES"))
+}
+
+func TestDefineReplicaSet_WithClusterDomain_AdvertisesFullyQualifiedURLs(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "example.internal")
+	require.Equal(t,
+		"http://bees.my-cluster.default.svc.example.internal:2380",
+		etcdContainerEnvVar(replicaSet, "ETCD_INITIAL_ADVERTISE_PEER_URLS"))
+	require.Equal(t,
+		"http://bees.my-cluster.default.svc.example.internal:2379",
+		etcdContainerEnvVar(replicaSet, "ETCD_ADVERTISE_CLIENT_URLS"))
+}
+
+func TestDefineReplicaSet_WithClusterDomain_AdvertisesItsInitialClusterEntry(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+						{Name: "magic", Host: "magic.my-cluster.default.svc"},
+					},
+				},
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	entries := strings.Split(etcdContainerEnvVar(replicaSet, "ETCD_INITIAL_CLUSTER"), ",")
+	require.Equal(t, "bees="+etcdContainerEnvVar(replicaSet, "ETCD_INITIAL_ADVERTISE_PEER_URLS"), entries[0])
+	require.Equal(t, "magic=http://magic.my-cluster.default.svc.cluster.local:2380", entries[1])
+}
+
+func TestDefineReplicaSet_WithAdvertiseURLs_AdvertisesOverrides(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.example.com"},
+					},
+				},
+			},
+			Advertise: &etcdv1alpha1.AdvertiseURLs{
+				PeerURLs:   []string{"http://bees.example.com:2380"},
+				ClientURLs: []string{"http://bees.example.com:32379", "http://10.0.0.1:2379"},
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	require.Equal(t, "http://bees.example.com:2380", etcdContainerEnvVar(replicaSet, "ETCD_INITIAL_ADVERTISE_PEER_URLS"))
+	require.Equal(t,
+		"http://bees.example.com:32379,http://10.0.0.1:2379",
+		etcdContainerEnvVar(replicaSet, "ETCD_ADVERTISE_CLIENT_URLS"))
+	// The listen URLs are unaffected.
+	require.Equal(t, "http://0.0.0.0:2380", etcdContainerEnvVar(replicaSet, "ETCD_LISTEN_PEER_URLS"))
+}
+
+func TestDefineReplicaSet_WithHostNetwork_AdvertisesPodIP(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "10.0.0.1"},
+					},
+				},
+			},
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				HostNetwork: true,
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	podSpec := replicaSet.Spec.Template.Spec
+	require.True(t, podSpec.HostNetwork)
+	require.Equal(t, corev1.DNSClusterFirstWithHostNet, podSpec.DNSPolicy)
+	require.Equal(t, int32(2380), podSpec.Containers[0].Ports[1].HostPort)
+
+	env := podSpec.Containers[0].Env
+	require.Equal(t, "POD_IP", env[0].Name)
+	require.Equal(t, "status.podIP", env[0].ValueFrom.FieldRef.FieldPath)
+	require.Equal(t, "http://$(POD_IP):2380", etcdContainerEnvVar(replicaSet, "ETCD_INITIAL_ADVERTISE_PEER_URLS"))
+	require.Equal(t, "http://$(POD_IP):2379", etcdContainerEnvVar(replicaSet, "ETCD_ADVERTISE_CLIENT_URLS"))
+}
+
+func TestDefineReplicaSet_WithExternalMembers_UsesTheirPeerURLs(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster"},
+						{Name: "magic", PeerURLs: []string{"http://etcd.eu-west.example.com:32380"}},
+						{Name: "goats", PeerURLs: []string{"http://10.1.0.5:32380", "http://10.1.0.6:32380"}},
+					},
+				},
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	require.Equal(t,
+		"bees=http://bees.my-cluster:2380,magic=http://etcd.eu-west.example.com:32380,"+
+			"goats=http://10.1.0.5:32380,goats=http://10.1.0.6:32380",
+		etcdContainerEnvVar(replicaSet, "ETCD_INITIAL_CLUSTER"))
+}
+
+func TestDefineReplicaSet_WithIPv6_ListensOnIPv6AndBracketsAddresses(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "fd00::1"},
+						{Name: "magic", Host: "[fd00::2]"},
+					},
+				},
+			},
+			IPFamily: etcdv1alpha1.IPv6Family,
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				HostNetwork: true,
+			},
+		},
+	}
+
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	require.Equal(t, "http://[::]:2380", etcdContainerEnvVar(replicaSet, "ETCD_LISTEN_PEER_URLS"))
+	require.Equal(t, "http://[::]:2379", etcdContainerEnvVar(replicaSet, "ETCD_LISTEN_CLIENT_URLS"))
+	require.Equal(t,
+		"bees=http://[fd00::1]:2380,magic=http://[fd00::2]:2380",
+		etcdContainerEnvVar(replicaSet, "ETCD_INITIAL_CLUSTER"))
+	require.Equal(t, "http://[$(POD_IP)]:2380", etcdContainerEnvVar(replicaSet, "ETCD_INITIAL_ADVERTISE_PEER_URLS"))
+}
+
+func TestDefineReplicaSet_WithChangedSpec_ChangesPodTemplateHash(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+		},
+	}
+
+	original := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	hash := original.Annotations[podTemplateHashAnnotation]
+	require.NotEmpty(t, hash)
+	require.Equal(t, hash, original.Spec.Template.Annotations[podTemplateHashAnnotation])
+
+	again := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	require.Equal(t, hash, again.Annotations[podTemplateHashAnnotation])
+
+	peer.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{PriorityClassName: "etcd-critical"}
+	changed := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	require.NotEqual(t, hash, changed.Annotations[podTemplateHashAnnotation])
+}
+
+func TestUpdateReplicaSet_WithChangedSpec_PatchesTemplateAndKeepsPod(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, etcdv1alpha1.AddToScheme(scheme))
+
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+		},
+	}
+	old := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "bees-abcde",
+			Namespace:   "default",
+			Labels:      old.Spec.Template.Labels,
+			Annotations: old.Spec.Template.Annotations,
+		},
+	}
+	r := &EtcdPeerReconciler{
+		Client:        fake.NewFakeClientWithScheme(scheme, &peer, &old, pod),
+		Log:           logf.NullLogger{},
+		EtcdImage:     "quay.io/coreos/etcd:v3.2.27",
+		ClusterDomain: "cluster.local",
+		Recorder:      record.NewFakeRecorder(10),
+	}
+
+	peer.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{
+		NodeSelector: map[string]string{"dedicated": "etcd"},
+	}
+	ctx := context.Background()
+	require.NoError(t, r.updateReplicaSet(ctx, logf.NullLogger{}, peer, old))
+
+	var replicaSet appsv1.ReplicaSet
+	require.NoError(t, r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "bees"}, &replicaSet))
+	hash := defineReplicaSet(peer, r.EtcdImage, r.ClusterDomain).Annotations[podTemplateHashAnnotation]
+	require.Equal(t, hash, replicaSet.Annotations[podTemplateHashAnnotation])
+	require.Equal(t, "etcd", replicaSet.Spec.Template.Spec.NodeSelector["dedicated"])
+
+	// The pod is replaced separately, by replaceOutdatedPod.
+	var existing corev1.Pod
+	require.NoError(t, r.Get(ctx, client.ObjectKey{Namespace: "default", Name: "bees-abcde"}, &existing))
+}
+
+func TestReconcilePeer_WithoutBootstrap_RecordsEventAndCreatesNothing(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, etcdv1alpha1.AddToScheme(scheme))
+
+	peer := &etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec:       etcdv1alpha1.EtcdPeerSpec{ClusterName: "my-cluster"},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &EtcdPeerReconciler{
+		Client:        fake.NewFakeClientWithScheme(scheme, peer),
+		Log:           logf.NullLogger{},
+		EtcdImage:     "quay.io/coreos/etcd:v3.2.27",
+		ClusterDomain: "cluster.local",
+		Recorder:      recorder,
+	}
+
+	ctx := context.Background()
+	req := reconcile.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "bees"}}
+	result, err := r.reconcilePeer(ctx, logf.NullLogger{}, req)
+	require.NoError(t, err)
+	require.Equal(t, reconcile.Result{}, result, "the peer should not be requeued")
+	require.Contains(t, <-recorder.Events, eventReasonInvalidSpec)
+
+	var replicaSet appsv1.ReplicaSet
+	err = r.Get(ctx, req.NamespacedName, &replicaSet)
+	require.True(t, apierrs.IsNotFound(err), "no ReplicaSet should be created, got %v", err)
+}
+
+func TestValidateReplicaSetIdentity_WithChangedInitialCluster_ReturnsError(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+		},
+	}
+	replicaSet := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+	require.NoError(t, validateReplicaSetIdentity(peer, replicaSet, "cluster.local"))
+
+	changed := *peer.DeepCopy()
+	changed.Spec.Bootstrap.Static.InitialCluster = append(changed.Spec.Bootstrap.Static.InitialCluster,
+		etcdv1alpha1.InitialClusterMember{Name: "magic", Host: "magic.my-cluster.default.svc"})
+	err := validateReplicaSetIdentity(changed, replicaSet, "cluster.local")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "spec.bootstrap.static.initialCluster")
+
+	// Replica sets which don't record the initial cluster are compared by
+	// their environment instead.
+	delete(replicaSet.Annotations, initialClusterAnnotation)
+	require.NoError(t, validateReplicaSetIdentity(peer, replicaSet, "cluster.local"))
+	require.Error(t, validateReplicaSetIdentity(changed, replicaSet, "cluster.local"))
+}
+
+func TestReplicaSetDrifted(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees", Host: "bees.my-cluster.default.svc"},
+					},
+				},
+			},
+		},
+	}
+	desired := defineReplicaSet(peer, "quay.io/coreos/etcd:v3.2.27", "cluster.local")
+
+	t.Run("WithDefaultedFields_ReportsNone", func(t *testing.T) {
+		existing := *desired.DeepCopy()
+		existing.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+		existing.Spec.Template.Spec.SchedulerName = corev1.DefaultSchedulerName
+		existing.Spec.Template.Spec.Containers[0].TerminationMessagePath = corev1.TerminationMessagePathDefault
+		existing.Spec.Template.Spec.Containers[0].ImagePullPolicy = corev1.PullIfNotPresent
+		existing.Annotations["deployment.kubernetes.io/revision"] = "1"
+		require.False(t, replicaSetDrifted(existing, desired))
+	})
+	t.Run("WithEditedImage_ReportsDrift", func(t *testing.T) {
+		existing := *desired.DeepCopy()
+		existing.Spec.Template.Spec.Containers[0].Image = "quay.io/coreos/etcd:v3.4.0"
+		require.True(t, replicaSetDrifted(existing, desired))
+	})
+	t.Run("WithRemovedEnvVar_ReportsDrift", func(t *testing.T) {
+		existing := *desired.DeepCopy()
+		container := &existing.Spec.Template.Spec.Containers[0]
+		container.Env = container.Env[1:]
+		require.True(t, replicaSetDrifted(existing, desired))
+	})
+	t.Run("WithScaledReplicas_ReportsDrift", func(t *testing.T) {
+		existing := *desired.DeepCopy()
+		replicas := int32(0)
+		existing.Spec.Replicas = &replicas
+		require.True(t, replicaSetDrifted(existing, desired))
 	})
 }
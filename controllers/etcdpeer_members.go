@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
+)
+
+// staleMember is an etcd member which no longer belongs to any EtcdPeer.
+type staleMember struct {
+	member etcd.Member
+	reason string
+}
+
+// findStaleMembers compares the members of a cluster with its EtcdPeers, and
+// returns the members which no longer belong to any of them:
+//
+//   - members named after an EtcdPeer which has been deleted.
+//   - members named after an EtcdPeer which records a different member ID,
+//     when that member is also present. These are left behind when a peer's
+//     member is replaced and the old member is not removed.
+//
+// Members named in the initial cluster of the peers which have no EtcdPeer
+// are taken to run outside this Kubernetes cluster, whether they were given
+// by host or by peer URLs, and are never stale.
+//
+// Members which have no name have not started yet, so can't be attributed to
+// a peer and are left alone. Nothing is reported unless every peer has
+// recorded its member ID, to avoid acting while the cluster is forming.
+func findStaleMembers(members []etcd.Member, peers []etcdv1alpha1.EtcdPeer) []staleMember {
+	recorded := make(map[string]string, len(peers))
+	initial := map[string]bool{}
+	for _, peer := range peers {
+		if peer.Status.MemberID == "" {
+			return nil
+		}
+		recorded[peer.Name] = peer.Status.MemberID
+		if peer.Spec.Bootstrap == nil || peer.Spec.Bootstrap.Static == nil {
+			continue
+		}
+		for _, member := range peer.Spec.Bootstrap.Static.InitialCluster {
+			initial[member.Name] = true
+		}
+	}
+	present := make(map[string]bool, len(members))
+	for _, member := range members {
+		present[strconv.FormatUint(member.ID, 16)] = true
+	}
+
+	var stale []staleMember
+	for _, member := range members {
+		if member.Name == "" {
+			continue
+		}
+		memberID := strconv.FormatUint(member.ID, 16)
+		recordedID, ok := recorded[member.Name]
+		switch {
+		case !ok && initial[member.Name]:
+			// An external member.
+		case !ok:
+			stale = append(stale, staleMember{
+				member: member,
+				reason: fmt.Sprintf("EtcdPeer %s no longer exists", member.Name),
+			})
+		case recordedID != memberID && present[recordedID]:
+			stale = append(stale, staleMember{
+				member: member,
+				reason: fmt.Sprintf("EtcdPeer %s has been replaced by member %s", member.Name, recordedID),
+			})
+		}
+	}
+	return stale
+}
+
+// listClusterPeers returns the EtcdPeers of the peer's cluster, including the
+// peer itself, which are not being deleted.
+func (r *EtcdPeerReconciler) listClusterPeers(ctx context.Context, peer etcdv1alpha1.EtcdPeer) ([]etcdv1alpha1.EtcdPeer, error) {
+	var peers etcdv1alpha1.EtcdPeerList
+	if err := r.List(ctx, &peers, client.InNamespace(peer.Namespace)); err != nil {
+		return nil, err
+	}
+	var clusterPeers []etcdv1alpha1.EtcdPeer
+	for _, p := range peers.Items {
+		if p.Spec.ClusterName == peer.Spec.ClusterName && p.DeletionTimestamp == nil {
+			clusterPeers = append(clusterPeers, p)
+		}
+	}
+	return clusterPeers, nil
+}
+
+// staleMemberSettings returns whether stale members are removed from the
+// peer's cluster, and how long they must have been stale first. The peer's
+// spec.membership overrides the operator's settings.
+func (r *EtcdPeerReconciler) staleMemberSettings(peer etcdv1alpha1.EtcdPeer) (bool, time.Duration) {
+	remove, gracePeriod := r.RemoveStaleMembers, r.StaleMemberGracePeriod
+	if membership := peer.Spec.Membership; membership != nil {
+		if membership.RemoveStaleMembers != nil {
+			remove = *membership.RemoveStaleMembers
+		}
+		if membership.StaleMemberGracePeriod != nil {
+			gracePeriod = membership.StaleMemberGracePeriod.Duration
+		}
+	}
+	return remove, gracePeriod
+}
+
+// reconcileStaleMembers removes the members of the peer's cluster which no
+// longer belong to any EtcdPeer, if the peer's member is the healthy leader of
+// its cluster. It is left to the peer's status to report a member which can't
+// be reached.
+func (r *EtcdPeerReconciler) reconcileStaleMembers(ctx context.Context, log logr.Logger, peer etcdv1alpha1.EtcdPeer) error {
+	removeStale, gracePeriod := r.staleMemberSettings(peer)
+	if !removeStale {
+		return nil
+	}
+
+	pod, err := r.findPeerPod(ctx, peer)
+	if err != nil {
+		return err
+	}
+	if pod == nil || !isPodReady(pod) || pod.Status.PodIP == "" {
+		return nil
+	}
+	httpClient, err := r.memberClient(ctx, peer)
+	if err != nil {
+		return err
+	}
+	endpoint := podClientEndpoint(peer, pod)
+	member, err := etcd.FetchMemberStatus(ctx, httpClient, endpoint)
+	if err != nil {
+		log.V(1).Info("Not removing stale etcd members, unable to query etcd member", "error", err.Error())
+		return nil
+	}
+	if !member.Healthy || member.MemberID != member.Leader {
+		return nil
+	}
+
+	if err := r.removeStaleMembers(ctx, log, peer, httpClient, endpoint, member.MemberID, gracePeriod); err != nil {
+		log.Error(err, "unable to remove stale etcd members")
+		return err
+	}
+	return nil
+}
+
+// removeStaleMembers removes the members of the peer's cluster which no longer
+// belong to any EtcdPeer. It is only run for the peer whose member is the
+// leader, so that a cluster is cleaned up once rather than by every peer.
+//
+// A voting member is only removed once it has been stale for `gracePeriod`,
+// and only while enough of the other members are healthy for the cluster to
+// keep its quorum without it. Learners don't vote, so are removed at once,
+// even when a voting member can't be.
+func (r *EtcdPeerReconciler) removeStaleMembers(ctx context.Context, log logr.Logger, peer etcdv1alpha1.EtcdPeer, httpClient *http.Client, endpoint *url.URL, self uint64, gracePeriod time.Duration) error {
+	clusterPeers, err := r.listClusterPeers(ctx, peer)
+	if err != nil {
+		return err
+	}
+
+	members, err := etcd.ListMembers(ctx, httpClient, endpoint)
+	if err != nil {
+		return err
+	}
+
+	key := clusterKey{peer.Namespace, peer.Spec.ClusterName}
+	confirmed := r.staleMembers.confirm(key, findStaleMembers(members, clusterPeers), time.Now(), gracePeriod)
+	for _, stale := range confirmed {
+		if stale.member.ID == self {
+			continue
+		}
+		if !stale.member.IsLearner && !keepsQuorumWithout(members, clusterPeers, self, stale.member.ID) {
+			log.Info("Not removing stale etcd member, too few of the other members are healthy",
+				"member", strconv.FormatUint(stale.member.ID, 16))
+			continue
+		}
+		log.Info("Removing stale etcd member", "member", strconv.FormatUint(stale.member.ID, 16),
+			"learner", stale.member.IsLearner, "reason", stale.reason)
+		r.Recorder.Eventf(&peer, corev1.EventTypeNormal, eventReasonStaleMemberRemoving,
+			"Removing stale member %x (%s) from cluster %s: %s", stale.member.ID, stale.member.Name, peer.Spec.ClusterName, stale.reason)
+		if err := etcd.RemoveMember(ctx, httpClient, endpoint, stale.member.ID); err != nil {
+			r.Recorder.Eventf(&peer, corev1.EventTypeWarning, eventReasonStaleMemberRemoveFailed,
+				"Failed to remove stale member %x (%s) from cluster %s: %s", stale.member.ID, stale.member.Name, peer.Spec.ClusterName, err)
+			return err
+		}
+		r.Recorder.Eventf(&peer, corev1.EventTypeNormal, eventReasonStaleMemberRemoved,
+			"Removed stale member %x (%s) from cluster %s: %s", stale.member.ID, stale.member.Name, peer.Spec.ClusterName, stale.reason)
+		members = withoutMember(members, stale.member.ID)
+	}
+	return nil
+}
+
+// keepsQuorumWithout reports whether the healthy voting members of the cluster
+// would still form a quorum once `remove` is removed. Learners don't count
+// towards the quorum. The leader, `self`, is known to be healthy. Other
+// members are healthy if the EtcdPeer which recorded them is ready.
+func keepsQuorumWithout(members []etcd.Member, peers []etcdv1alpha1.EtcdPeer, self, remove uint64) bool {
+	ready := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		if isPeerReady(peer) {
+			ready[peer.Status.MemberID] = true
+		}
+	}
+	healthy, remaining := 0, 0
+	for _, member := range members {
+		if member.ID == remove || member.IsLearner {
+			continue
+		}
+		remaining++
+		if member.ID == self || ready[strconv.FormatUint(member.ID, 16)] {
+			healthy++
+		}
+	}
+	return healthy >= remaining/2+1
+}
+
+func withoutMember(members []etcd.Member, id uint64) []etcd.Member {
+	var remaining []etcd.Member
+	for _, member := range members {
+		if member.ID != id {
+			remaining = append(remaining, member)
+		}
+	}
+	return remaining
+}
+
+// staleMemberTracker remembers when each stale member was first seen, so that
+// members are only removed once they have been stale for a while. A member
+// which is missing from one of the EtcdPeers briefly, for example while a
+// peer is being recreated, is not removed. The zero value is ready to use.
+type staleMemberTracker struct {
+	mu        sync.Mutex
+	firstSeen map[clusterKey]map[uint64]time.Time
+}
+
+// confirm records the members of the cluster which are stale at `now`, and
+// returns those which have been stale for at least `gracePeriod`. Learners
+// are returned at once, as removing them can't affect the cluster's quorum.
+// Members which are no longer stale are forgotten.
+func (t *staleMemberTracker) confirm(key clusterKey, stale []staleMember, now time.Time, gracePeriod time.Duration) []staleMember {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.firstSeen == nil {
+		t.firstSeen = make(map[clusterKey]map[uint64]time.Time)
+	}
+	previous := t.firstSeen[key]
+	current := make(map[uint64]time.Time, len(stale))
+	var confirmed []staleMember
+	for _, s := range stale {
+		firstSeen, ok := previous[s.member.ID]
+		if !ok {
+			firstSeen = now
+		}
+		current[s.member.ID] = firstSeen
+		if s.member.IsLearner || now.Sub(firstSeen) >= gracePeriod {
+			confirmed = append(confirmed, s)
+		}
+	}
+	if len(current) == 0 {
+		delete(t.firstSeen, key)
+	} else {
+		t.firstSeen[key] = current
+	}
+	return confirmed
+}
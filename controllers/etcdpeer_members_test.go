@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
+)
+
+func peerWithMemberID(name, memberID string) etcdv1alpha1.EtcdPeer {
+	return etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     etcdv1alpha1.EtcdPeerStatus{MemberID: memberID},
+	}
+}
+
+func readyPeerWithMemberID(name, memberID string) etcdv1alpha1.EtcdPeer {
+	peer := peerWithMemberID(name, memberID)
+	peer.Status.Conditions = []etcdv1alpha1.EtcdPeerCondition{
+		{Type: etcdv1alpha1.EtcdPeerReady, Status: corev1.ConditionTrue},
+	}
+	return peer
+}
+
+func TestFindStaleMembers_WithMatchingPeers_FindsNone(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa, Name: "bees-0"}, {ID: 0xb, Name: "bees-1"}, {ID: 0xc}}
+	peers := []etcdv1alpha1.EtcdPeer{peerWithMemberID("bees-0", "a"), peerWithMemberID("bees-1", "b")}
+
+	require.Empty(t, findStaleMembers(members, peers))
+}
+
+func TestFindStaleMembers_WithDeletedPeer_FindsItsMember(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa, Name: "bees-0"}, {ID: 0xb, Name: "bees-1"}}
+	peers := []etcdv1alpha1.EtcdPeer{peerWithMemberID("bees-0", "a")}
+
+	stale := findStaleMembers(members, peers)
+	require.Len(t, stale, 1)
+	require.Equal(t, uint64(0xb), stale[0].member.ID)
+}
+
+func TestFindStaleMembers_WithReplacedMember_FindsOldMember(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa, Name: "bees-0"}, {ID: 0xd, Name: "bees-0"}}
+	peers := []etcdv1alpha1.EtcdPeer{peerWithMemberID("bees-0", "d")}
+
+	stale := findStaleMembers(members, peers)
+	require.Len(t, stale, 1)
+	require.Equal(t, uint64(0xa), stale[0].member.ID)
+}
+
+func TestFindStaleMembers_WithRecordedMemberMissing_FindsNone(t *testing.T) {
+	// The recorded ID may be out of date, so the named member is kept.
+	members := []etcd.Member{{ID: 0xa, Name: "bees-0"}}
+	peers := []etcdv1alpha1.EtcdPeer{peerWithMemberID("bees-0", "d")}
+
+	require.Empty(t, findStaleMembers(members, peers))
+}
+
+func TestFindStaleMembers_WithPeerWithoutMemberID_FindsNone(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa, Name: "bees-0"}, {ID: 0xb, Name: "bees-1"}}
+	peers := []etcdv1alpha1.EtcdPeer{peerWithMemberID("bees-2", "")}
+
+	require.Empty(t, findStaleMembers(members, peers))
+}
+
+func TestFindStaleMembers_WithExternalMember_KeepsIt(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa, Name: "bees-0"}, {ID: 0xe, Name: "eu-west"}, {ID: 0xf, Name: "bees-1"}}
+	peer := peerWithMemberID("bees-0", "a")
+	peer.Spec.Bootstrap = &etcdv1alpha1.Bootstrap{
+		Static: &etcdv1alpha1.StaticBootstrap{
+			InitialCluster: []etcdv1alpha1.InitialClusterMember{
+				{Name: "bees-0", Host: "bees-0.my-cluster.default.svc"},
+				{Name: "eu-west", PeerURLs: []string{"http://etcd.eu-west.example.com:32380"}},
+			},
+		},
+	}
+
+	// bees-1 has no EtcdPeer, while eu-west runs outside this cluster.
+	stale := findStaleMembers(members, []etcdv1alpha1.EtcdPeer{peer})
+	require.Len(t, stale, 1)
+	require.Equal(t, uint64(0xf), stale[0].member.ID)
+}
+
+func TestFindStaleMembers_WithExternalMemberGivenByHost_KeepsIt(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa, Name: "bees-0"}, {ID: 0xe, Name: "eu-west"}}
+	peer := peerWithMemberID("bees-0", "a")
+	peer.Spec.Bootstrap = &etcdv1alpha1.Bootstrap{
+		Static: &etcdv1alpha1.StaticBootstrap{
+			InitialCluster: []etcdv1alpha1.InitialClusterMember{
+				{Name: "bees-0", Host: "bees-0.my-cluster.default.svc"},
+				{Name: "eu-west", Host: "etcd.eu-west.example.com"},
+			},
+		},
+	}
+
+	require.Empty(t, findStaleMembers(members, []etcdv1alpha1.EtcdPeer{peer}))
+}
+
+func TestStaleMemberTracker_WithinGracePeriod_ConfirmsNone(t *testing.T) {
+	var tracker staleMemberTracker
+	key := clusterKey{"default", "my-cluster"}
+	stale := []staleMember{{member: etcd.Member{ID: 0xb, Name: "bees-1"}}}
+	start := time.Now()
+
+	require.Empty(t, tracker.confirm(key, stale, start, time.Minute))
+	require.Empty(t, tracker.confirm(key, stale, start.Add(30*time.Second), time.Minute))
+
+	confirmed := tracker.confirm(key, stale, start.Add(time.Minute), time.Minute)
+	require.Len(t, confirmed, 1)
+	require.Equal(t, uint64(0xb), confirmed[0].member.ID)
+}
+
+func TestStaleMemberTracker_WhenNoLongerStale_StartsAgain(t *testing.T) {
+	var tracker staleMemberTracker
+	key := clusterKey{"default", "my-cluster"}
+	stale := []staleMember{{member: etcd.Member{ID: 0xb, Name: "bees-1"}}}
+	start := time.Now()
+
+	tracker.confirm(key, stale, start, time.Minute)
+	tracker.confirm(key, nil, start.Add(30*time.Second), time.Minute)
+	require.Empty(t, tracker.confirm(key, stale, start.Add(time.Minute), time.Minute))
+	require.Len(t, tracker.confirm(key, stale, start.Add(2*time.Minute), time.Minute), 1)
+}
+
+func TestStaleMemberTracker_WithLearner_ConfirmsAtOnce(t *testing.T) {
+	var tracker staleMemberTracker
+	key := clusterKey{"default", "my-cluster"}
+	stale := []staleMember{{member: etcd.Member{ID: 0xb, Name: "bees-1", IsLearner: true}}}
+
+	require.Len(t, tracker.confirm(key, stale, time.Now(), time.Minute), 1)
+}
+
+func TestStaleMemberSettings_WithMembership_OverridesOperator(t *testing.T) {
+	r := &EtcdPeerReconciler{RemoveStaleMembers: false, StaleMemberGracePeriod: 5 * time.Minute}
+	peer := peerWithMemberID("bees-0", "a")
+
+	remove, gracePeriod := r.staleMemberSettings(peer)
+	require.False(t, remove)
+	require.Equal(t, 5*time.Minute, gracePeriod)
+
+	enabled := true
+	peer.Spec.Membership = &etcdv1alpha1.Membership{
+		RemoveStaleMembers:     &enabled,
+		StaleMemberGracePeriod: &metav1.Duration{Duration: time.Minute},
+	}
+	remove, gracePeriod = r.staleMemberSettings(peer)
+	require.True(t, remove)
+	require.Equal(t, time.Minute, gracePeriod)
+}
+
+func TestKeepsQuorumWithout_WithHealthyPeers_AllowsRemoval(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa}, {ID: 0xb}, {ID: 0xc}, {ID: 0xd}}
+	peers := []etcdv1alpha1.EtcdPeer{
+		readyPeerWithMemberID("bees-0", "a"),
+		readyPeerWithMemberID("bees-1", "b"),
+		peerWithMemberID("bees-2", "c"),
+	}
+
+	// 0xa, the leader, and 0xb are two of the three remaining members.
+	require.True(t, keepsQuorumWithout(members, peers, 0xa, 0xd))
+}
+
+func TestKeepsQuorumWithout_WithUnhealthyPeers_RefusesRemoval(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa}, {ID: 0xb}, {ID: 0xc}, {ID: 0xd}, {ID: 0xe}}
+	peers := []etcdv1alpha1.EtcdPeer{
+		readyPeerWithMemberID("bees-0", "a"),
+		readyPeerWithMemberID("bees-1", "b"),
+		peerWithMemberID("bees-2", "c"),
+		peerWithMemberID("bees-3", "d"),
+	}
+
+	// Only 0xa and 0xb of the four remaining members are healthy.
+	require.False(t, keepsQuorumWithout(members, peers, 0xa, 0xe))
+}
+
+func TestKeepsQuorumWithout_WithLearners_CountsOnlyVoters(t *testing.T) {
+	members := []etcd.Member{{ID: 0xa}, {ID: 0xb}, {ID: 0xc}, {ID: 0xd, IsLearner: true}, {ID: 0xe, IsLearner: true}}
+	peers := []etcdv1alpha1.EtcdPeer{
+		readyPeerWithMemberID("bees-0", "a"),
+		peerWithMemberID("bees-1", "b"),
+	}
+
+	// 0xa, the leader, is one of the two remaining voters.
+	require.False(t, keepsQuorumWithout(members, peers, 0xa, 0xc))
+
+	peers[1] = readyPeerWithMemberID("bees-1", "b")
+	require.True(t, keepsQuorumWithout(members, peers, 0xa, 0xc))
+}
+
+func TestRemoveStaleMembers_WhenVoterWouldLoseQuorum_StillRemovesLearners(t *testing.T) {
+	var removed []uint64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/cluster/member/list", func(w http.ResponseWriter, r *http.Request) {
+		// The stale voter is listed before the stale learner.
+		_, _ = w.Write([]byte(`{"members": [
+			{"ID": "10", "name": "bees-0"},
+			{"ID": "11", "name": "bees-1"},
+			{"ID": "12", "name": "bees-2"},
+			{"ID": "13", "name": "gone-voter"},
+			{"ID": "14", "name": "gone-learner", "isLearner": true}
+		]}`))
+	})
+	mux.HandleFunc("/v3/cluster/member/remove", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID uint64 `json:"ID,string"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		removed = append(removed, req.ID)
+		_, _ = w.Write([]byte(`{}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, etcdv1alpha1.AddToScheme(scheme))
+	// Only the leader, bees-0, is healthy, so no voter can be removed.
+	peers := []etcdv1alpha1.EtcdPeer{
+		readyPeerWithMemberID("bees-0", "a"),
+		peerWithMemberID("bees-1", "b"),
+		peerWithMemberID("bees-2", "c"),
+	}
+	var objects []runtime.Object
+	for i := range peers {
+		peers[i].Namespace = "default"
+		peers[i].Spec.ClusterName = "bees"
+		objects = append(objects, &peers[i])
+	}
+	r := &EtcdPeerReconciler{
+		Client:   fake.NewFakeClientWithScheme(scheme, objects...),
+		Recorder: record.NewFakeRecorder(10),
+	}
+
+	err = r.removeStaleMembers(context.Background(), logf.NullLogger{}, peers[0], server.Client(), endpoint, 0xa, 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0xe}, removed)
+}
@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;create;patch
+
+// defineNetworkPolicy builds a NetworkPolicy for the peer's pod. Peer traffic
+// is only allowed from the other peers of the cluster and from any external
+// peer address ranges, and client traffic from the peers, from the cluster's
+// EtcdProxy pods and from the clients selected by the peer.
+func defineNetworkPolicy(peer etcdv1alpha1.EtcdPeer) networkingv1.NetworkPolicy {
+	tcp := corev1.ProtocolTCP
+	peerPort := intstr.FromInt(etcdPeerPort)
+	clientPort := intstr.FromInt(etcdClientPort)
+
+	clusterMembers := networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{
+				appLabel:     appName,
+				clusterLabel: peer.Spec.ClusterName,
+			},
+		},
+	}
+	peers := []networkingv1.NetworkPolicyPeer{clusterMembers}
+	for _, cidr := range peer.Spec.NetworkPolicy.PeerCIDRs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+		})
+	}
+	clusterProxies := networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{
+				appLabel:     proxyAppName,
+				clusterLabel: peer.Spec.ClusterName,
+			},
+		},
+	}
+	clients := []networkingv1.NetworkPolicyPeer{clusterMembers, clusterProxies}
+	if policy := peer.Spec.NetworkPolicy; policy.ClientNamespaceSelector != nil || policy.ClientPodSelector != nil {
+		clients = append(clients, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: policy.ClientNamespaceSelector,
+			PodSelector:       policy.ClientPodSelector,
+		})
+	}
+
+	labels := map[string]string{
+		appLabel:     appName,
+		clusterLabel: peer.Spec.ClusterName,
+		peerLabel:    peer.Name,
+	}
+	return networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:          labels,
+			Name:            peer.Name,
+			Namespace:       peer.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(&peer, etcdv1alpha1.GroupVersion.WithKind("EtcdPeer"))},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: labels},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &peerPort}},
+					From:  peers,
+				},
+				{
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &clientPort}},
+					From:  clients,
+				},
+			},
+		},
+	}
+}
+
+// reconcileNetworkPolicy creates the peer's NetworkPolicy if it is missing,
+// and patches it back to the desired spec if it has drifted.
+func (r *EtcdPeerReconciler) reconcileNetworkPolicy(ctx context.Context, log logr.Logger, peer etcdv1alpha1.EtcdPeer) error {
+	desired := defineNetworkPolicy(peer)
+
+	var existing networkingv1.NetworkPolicy
+	err := r.Get(ctx, client.ObjectKey{Namespace: peer.Namespace, Name: peer.Name}, &existing)
+	if apierrs.IsNotFound(err) {
+		log.V(1).Info("NetworkPolicy does not exist, creating")
+		if err := r.Create(ctx, &desired); err != nil {
+			log.Error(err, "unable to create NetworkPolicy for EtcdPeer", "networkPolicy", desired.Name)
+			r.Recorder.Eventf(&peer, corev1.EventTypeWarning, eventReasonCreateFailed,
+				"Failed to create NetworkPolicy %s: %s", desired.Name, err)
+			return err
+		}
+		r.Recorder.Eventf(&peer, corev1.EventTypeNormal, eventReasonPolicyCreated,
+			"Created NetworkPolicy %s", desired.Name)
+		return nil
+	}
+	if err != nil {
+		log.Error(err, "unable to query for network policies")
+		return err
+	}
+
+	if apiequality.Semantic.DeepEqual(existing.Spec, desired.Spec) {
+		return nil
+	}
+	log.V(1).Info("NetworkPolicy has drifted, patching")
+	patch := client.MergeFrom(existing.DeepCopy())
+	existing.Spec = desired.Spec
+	if err := r.Patch(ctx, &existing, patch); err != nil {
+		log.Error(err, "unable to patch NetworkPolicy for EtcdPeer", "networkPolicy", existing.Name)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+func TestDefineNetworkPolicy_WithClientSelectors_AllowsClientsOnClientPortOnly(t *testing.T) {
+	clientPods := &metav1.LabelSelector{MatchLabels: map[string]string{"etcd-client": "true"}}
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			NetworkPolicy: &etcdv1alpha1.NetworkPolicy{
+				ClientPodSelector: clientPods,
+			},
+		},
+	}
+
+	policy := defineNetworkPolicy(peer)
+	require.Equal(t, "bees", policy.Spec.PodSelector.MatchLabels[peerLabel])
+	require.Len(t, policy.Spec.Ingress, 2)
+
+	peerRule := policy.Spec.Ingress[0]
+	require.Equal(t, 2380, peerRule.Ports[0].Port.IntValue())
+	require.Len(t, peerRule.From, 1)
+	require.Equal(t, "my-cluster", peerRule.From[0].PodSelector.MatchLabels[clusterLabel])
+
+	clientRule := policy.Spec.Ingress[1]
+	require.Equal(t, 2379, clientRule.Ports[0].Port.IntValue())
+	require.Len(t, clientRule.From, 3)
+	require.Equal(t, clientPods, clientRule.From[2].PodSelector)
+	require.Nil(t, clientRule.From[2].NamespaceSelector)
+}
+
+func TestDefineNetworkPolicy_WithoutClientSelectors_OnlyAllowsClusterMembersAndProxies(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName:   "my-cluster",
+			NetworkPolicy: &etcdv1alpha1.NetworkPolicy{},
+		},
+	}
+
+	policy := defineNetworkPolicy(peer)
+	clientRule := policy.Spec.Ingress[1]
+	require.Len(t, clientRule.From, 2)
+	require.Equal(t, appName, clientRule.From[0].PodSelector.MatchLabels[appLabel])
+
+	// The cluster's proxies must match the selector, or they can't reach the
+	// peers they forward to.
+	proxyPods := defineProxyDeployment(exampleProxy(), []string{"http://bees.my-cluster.default.svc.cluster.local:2379"}, "quay.io/coreos/etcd:v3.2.27").Spec.Template.Labels
+	selector, err := metav1.LabelSelectorAsSelector(clientRule.From[1].PodSelector)
+	require.NoError(t, err)
+	require.True(t, selector.Matches(labels.Set(proxyPods)))
+	require.Nil(t, clientRule.From[1].NamespaceSelector)
+}
+
+func TestDefineNetworkPolicy_WithPeerCIDRs_AllowsThemOnPeerPortOnly(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "bees", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "my-cluster",
+			NetworkPolicy: &etcdv1alpha1.NetworkPolicy{
+				PeerCIDRs: []string{"10.20.0.0/16"},
+			},
+		},
+	}
+
+	policy := defineNetworkPolicy(peer)
+	peerRule := policy.Spec.Ingress[0]
+	require.Len(t, peerRule.From, 2)
+	require.Equal(t, "10.20.0.0/16", peerRule.From[1].IPBlock.CIDR)
+	require.Len(t, policy.Spec.Ingress[1].From, 2)
+}
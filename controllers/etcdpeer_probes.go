@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+const etcdHealthPath = "/health"
+
+// defaultLivenessProbe gives a member which has lost its leader, or is
+// replaying its log on start up, a good while to recover before it is
+// restarted.
+var defaultLivenessProbe = corev1.Probe{
+	InitialDelaySeconds: 15,
+	TimeoutSeconds:      5,
+	PeriodSeconds:       10,
+	SuccessThreshold:    1,
+	FailureThreshold:    8,
+}
+
+// defaultReadinessProbe takes a member out of service quickly once it can no
+// longer serve consistent reads.
+var defaultReadinessProbe = corev1.Probe{
+	InitialDelaySeconds: 5,
+	TimeoutSeconds:      5,
+	PeriodSeconds:       5,
+	SuccessThreshold:    1,
+	FailureThreshold:    3,
+}
+
+// etcdHealthHandler checks the health of the member from within its pod.
+// etcd's health check makes a linearized read, so it only passes when the
+// member is part of a quorate cluster.
+//
+// When clients must present a certificate the kubelet can't make the check
+// itself, so `etcdctl` is run in the container with the client certificate
+// mounted for it. The server certificate must be valid for `localhost`.
+func etcdHealthHandler(peer etcdv1alpha1.EtcdPeer) corev1.Handler {
+	if peer.ServerTLSSecretName() == "" {
+		return corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   etcdHealthPath,
+				Port:   intstr.FromInt(etcdClientPort),
+				Scheme: corev1.URISchemeHTTP,
+			},
+		}
+	}
+	return corev1.Handler{
+		Exec: &corev1.ExecAction{
+			Command: []string{
+				"/bin/sh", "-ec",
+				fmt.Sprintf(
+					"ETCDCTL_API=3 etcdctl --endpoints=%s://localhost:%d --cacert=%s --cert=%s --key=%s endpoint health",
+					etcdSchemeHTTPS, etcdClientPort,
+					path.Join(clientTLSMountPath, tlsCAKey),
+					path.Join(clientTLSMountPath, corev1.TLSCertKey),
+					path.Join(clientTLSMountPath, corev1.TLSPrivateKeyKey),
+				),
+			},
+		},
+	}
+}
+
+// applyProbeThresholds overrides the timing of `probe` with any thresholds set
+// on the peer.
+func applyProbeThresholds(probe *corev1.Probe, thresholds *etcdv1alpha1.ProbeThresholds) {
+	if thresholds == nil {
+		return
+	}
+	if thresholds.InitialDelaySeconds != nil {
+		probe.InitialDelaySeconds = *thresholds.InitialDelaySeconds
+	}
+	if thresholds.TimeoutSeconds != nil {
+		probe.TimeoutSeconds = *thresholds.TimeoutSeconds
+	}
+	if thresholds.PeriodSeconds != nil {
+		probe.PeriodSeconds = *thresholds.PeriodSeconds
+	}
+	if thresholds.SuccessThreshold != nil {
+		probe.SuccessThreshold = *thresholds.SuccessThreshold
+	}
+	if thresholds.FailureThreshold != nil {
+		probe.FailureThreshold = *thresholds.FailureThreshold
+	}
+}
+
+// etcdProbes returns the liveness and readiness probes of the etcd container.
+func etcdProbes(peer etcdv1alpha1.EtcdPeer) (liveness, readiness *corev1.Probe) {
+	liveness = defaultLivenessProbe.DeepCopy()
+	liveness.Handler = etcdHealthHandler(peer)
+	readiness = defaultReadinessProbe.DeepCopy()
+	readiness.Handler = etcdHealthHandler(peer)
+
+	if template := peer.Spec.PodTemplate; template != nil {
+		applyProbeThresholds(liveness, template.LivenessProbe)
+		applyProbeThresholds(readiness, template.ReadinessProbe)
+	}
+	return liveness, readiness
+}
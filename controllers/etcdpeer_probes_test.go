@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+func TestEtcdProbes_WithoutTLS_ChecksHealthOverHTTP(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{}
+
+	liveness, readiness := etcdProbes(peer)
+	for _, probe := range []struct {
+		name, path string
+		port       int
+	}{
+		{"liveness", liveness.HTTPGet.Path, liveness.HTTPGet.Port.IntValue()},
+		{"readiness", readiness.HTTPGet.Path, readiness.HTTPGet.Port.IntValue()},
+	} {
+		require.Equal(t, "/health", probe.path, probe.name)
+		require.Equal(t, 2379, probe.port, probe.name)
+	}
+	require.Equal(t, defaultLivenessProbe.FailureThreshold, liveness.FailureThreshold)
+	require.Equal(t, defaultReadinessProbe.PeriodSeconds, readiness.PeriodSeconds)
+}
+
+func TestEtcdProbes_WithServerTLS_RunsEtcdctlWithClientCertificate(t *testing.T) {
+	peer := etcdv1alpha1.EtcdPeer{
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			TLS: &etcdv1alpha1.TLS{ServerSecretName: "server-tls", ClientSecretName: "client-tls"},
+		},
+	}
+
+	liveness, readiness := etcdProbes(peer)
+	require.Nil(t, liveness.HTTPGet)
+	require.NotNil(t, liveness.Exec)
+	require.Contains(t, liveness.Exec.Command[2], "--cert=/etc/etcd/tls/client/tls.crt")
+	require.Contains(t, liveness.Exec.Command[2], "--key=/etc/etcd/tls/client/tls.key")
+	require.Contains(t, liveness.Exec.Command[2], "endpoint health")
+	require.Equal(t, liveness.Exec, readiness.Exec)
+}
+
+func TestEtcdProbes_WithThresholds_OverridesDefaults(t *testing.T) {
+	delay, failures := int32(0), int32(30)
+	peer := etcdv1alpha1.EtcdPeer{
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			PodTemplate: &etcdv1alpha1.EtcdPodTemplateSpec{
+				LivenessProbe: &etcdv1alpha1.ProbeThresholds{
+					InitialDelaySeconds: &delay,
+					FailureThreshold:    &failures,
+				},
+			},
+		},
+	}
+
+	liveness, readiness := etcdProbes(peer)
+	require.Equal(t, int32(0), liveness.InitialDelaySeconds)
+	require.Equal(t, int32(30), liveness.FailureThreshold)
+	require.Equal(t, defaultLivenessProbe.PeriodSeconds, liveness.PeriodSeconds)
+	require.Equal(t, defaultReadinessProbe.FailureThreshold, readiness.FailureThreshold)
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
+)
+
+// clusterPods returns the running pods of the peer's cluster by the name of
+// the peer they belong to. Pods which are being deleted are left out.
+func (r *EtcdPeerReconciler) clusterPods(ctx context.Context, peer etcdv1alpha1.EtcdPeer) (map[string]*corev1.Pod, error) {
+	var pods corev1.PodList
+	err := r.List(ctx, &pods,
+		client.InNamespace(peer.Namespace),
+		client.MatchingLabels{
+			appLabel:     appName,
+			clusterLabel: peer.Spec.ClusterName,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	byPeer := make(map[string]*corev1.Pod, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp == nil {
+			byPeer[pod.Labels[peerLabel]] = pod
+		}
+	}
+	return byPeer, nil
+}
+
+// replaceOutdatedPod deletes the peer's pod if it was created from an older
+// pod template than the one its spec defines now, so that the ReplicaSet
+// recreates it from the current one. Deleting the pod takes its member out of
+// the cluster until the new pod is running, so it is only done when:
+//
+//   - no other pod of the cluster is being replaced.
+//   - every other peer of the cluster, and its pod, is ready.
+//   - the cluster keeps its quorum without the peer's member.
+//
+// Otherwise the pod is left alone, and the replacement is tried again when
+// the peer is next reconciled.
+func (r *EtcdPeerReconciler) replaceOutdatedPod(ctx context.Context, log logr.Logger, peer etcdv1alpha1.EtcdPeer) error {
+	hash := defineReplicaSet(peer, r.EtcdImage, r.ClusterDomain).Annotations[podTemplateHashAnnotation]
+	pods, err := r.clusterPods(ctx, peer)
+	if err != nil {
+		return err
+	}
+	pod := pods[peer.Name]
+	if pod == nil || pod.Annotations[podTemplateHashAnnotation] == hash {
+		return nil
+	}
+
+	peers, err := r.listClusterPeers(ctx, peer)
+	if err != nil {
+		return err
+	}
+	key := clusterKey{peer.Namespace, peer.Spec.ClusterName}
+	if replacing, ok := r.podReplacements.inProgress(key, pods, peers); ok {
+		log.V(1).Info("Not replacing outdated pod, another pod of the cluster is being replaced", "peer", replacing)
+		return nil
+	}
+
+	var others []etcdv1alpha1.EtcdPeer
+	for _, other := range peers {
+		if other.Name == peer.Name {
+			continue
+		}
+		otherPod := pods[other.Name]
+		if otherPod == nil || !isPodReady(otherPod) || otherPod.Status.PodIP == "" || !isPeerReady(other) {
+			log.V(1).Info("Not replacing outdated pod, another peer of the cluster is not ready", "peer", other.Name)
+			return nil
+		}
+		others = append(others, other)
+	}
+	if len(others) == 0 {
+		log.V(1).Info("Not replacing outdated pod, the peer is the only one in its cluster")
+		return nil
+	}
+
+	// Every other member is healthy, so any of them can list the members.
+	httpClient, err := r.memberClient(ctx, others[0])
+	if err != nil {
+		return err
+	}
+	members, err := etcd.ListMembers(ctx, httpClient, podClientEndpoint(others[0], pods[others[0].Name]))
+	if err != nil {
+		return err
+	}
+	var memberID uint64
+	if peer.Status.MemberID != "" {
+		if memberID, err = strconv.ParseUint(peer.Status.MemberID, 16, 64); err != nil {
+			return fmt.Errorf("invalid member ID %q in status: %w", peer.Status.MemberID, err)
+		}
+	}
+	// None of the members is known to be healthy other than through the
+	// status of its peer.
+	if !keepsQuorumWithout(members, peers, 0, memberID) {
+		log.Info("Not replacing outdated pod, the cluster would lose its quorum without it", "pod", pod.Name)
+		return nil
+	}
+
+	if !r.podReplacements.claim(key, peer.Name, pod.UID) {
+		return nil
+	}
+	log.Info("Replacing pod created from an outdated pod template", "pod", pod.Name, "podTemplateHash", hash)
+	if err := r.Delete(ctx, pod, client.Preconditions{UID: &pod.UID}); err != nil && !apierrs.IsNotFound(err) {
+		r.podReplacements.release(key)
+		log.Error(err, "unable to delete outdated pod", "pod", pod.Name)
+		return err
+	}
+	r.Recorder.Eventf(&peer, corev1.EventTypeNormal, eventReasonPodReplaced,
+		"Deleted pod %s, which was created from an outdated pod template, for its ReplicaSet to recreate", pod.Name)
+	return nil
+}
+
+// podReplacementTracker remembers the pod of each cluster which has been
+// deleted to be replaced, until its replacement is ready. This keeps
+// replacements to one at a time even before the deletion reaches the cache
+// that the other peers are checked against. The zero value is ready to use.
+type podReplacementTracker struct {
+	mu      sync.Mutex
+	pending map[clusterKey]podReplacement
+}
+
+type podReplacement struct {
+	peer string
+	pod  types.UID
+}
+
+// inProgress reports whether a pod of the cluster is still being replaced,
+// and for which peer. A replacement is finished once the peer has a ready pod
+// other than the one which was deleted, or once the peer is gone.
+func (t *podReplacementTracker) inProgress(key clusterKey, pods map[string]*corev1.Pod, peers []etcdv1alpha1.EtcdPeer) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	replacement, ok := t.pending[key]
+	if !ok {
+		return "", false
+	}
+	exists := false
+	for _, peer := range peers {
+		if peer.Name == replacement.peer {
+			exists = true
+		}
+	}
+	pod := pods[replacement.peer]
+	if !exists || pod != nil && pod.UID != replacement.pod && isPodReady(pod) {
+		delete(t.pending, key)
+		return "", false
+	}
+	return replacement.peer, true
+}
+
+// claim records that the pod of the peer is about to be replaced, unless
+// another pod of the cluster already is.
+func (t *podReplacementTracker) claim(key clusterKey, peer string, pod types.UID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[clusterKey]podReplacement)
+	}
+	if _, ok := t.pending[key]; ok {
+		return false
+	}
+	t.pending[key] = podReplacement{peer: peer, pod: pod}
+	return true
+}
+
+// release forgets a replacement which was claimed but not carried out.
+func (t *podReplacementTracker) release(key clusterKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, key)
+}
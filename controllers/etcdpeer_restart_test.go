@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
+)
+
+const restartTestImage = "quay.io/coreos/etcd:v3.2.27"
+
+func restartTestPeer(name, memberID string, ready bool) *etcdv1alpha1.EtcdPeer {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &etcdv1alpha1.EtcdPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdPeerSpec{
+			ClusterName: "bees",
+			Bootstrap: &etcdv1alpha1.Bootstrap{
+				Static: &etcdv1alpha1.StaticBootstrap{
+					InitialCluster: []etcdv1alpha1.InitialClusterMember{
+						{Name: "bees-0", Host: "bees-0.bees.default.svc"},
+						{Name: "bees-1", Host: "bees-1.bees.default.svc"},
+						{Name: "bees-2", Host: "bees-2.bees.default.svc"},
+					},
+				},
+			},
+		},
+		Status: etcdv1alpha1.EtcdPeerStatus{
+			MemberID: memberID,
+			Conditions: []etcdv1alpha1.EtcdPeerCondition{
+				{Type: etcdv1alpha1.EtcdPeerReady, Status: status},
+			},
+		},
+	}
+}
+
+// podFromReplicaSet does what the ReplicaSet controller would, creating a
+// ready pod from the ReplicaSet's template.
+func podFromReplicaSet(replicaSet appsv1.ReplicaSet, uid string) *corev1.Pod {
+	template := replicaSet.Spec.Template.DeepCopy()
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-%s", replicaSet.Name, uid),
+			Namespace:   replicaSet.Namespace,
+			UID:         types.UID(uid),
+			Labels:      template.Labels,
+			Annotations: template.Annotations,
+		},
+		Spec: template.Spec,
+		Status: corev1.PodStatus{
+			PodIP:      "10.0.0.1",
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+// fakeMemberList serves a member list with a voting member for each ID.
+func fakeMemberList(ids ...uint64) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/cluster/member/list", func(w http.ResponseWriter, r *http.Request) {
+		body := `{"members": [`
+		for i, id := range ids {
+			if i > 0 {
+				body += ","
+			}
+			body += fmt.Sprintf(`{"ID": "%d", "name": "bees-%d"}`, id, i)
+		}
+		body += `]}`
+		_, _ = w.Write([]byte(body))
+	})
+	return httptest.NewServer(mux)
+}
+
+func restartTestReconciler(t *testing.T, server *httptest.Server, peers ...*etcdv1alpha1.EtcdPeer) *EtcdPeerReconciler {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, etcdv1alpha1.AddToScheme(scheme))
+
+	var objects []runtime.Object
+	for i, peer := range peers {
+		replicaSet := defineReplicaSet(*peer, restartTestImage, "cluster.local")
+		objects = append(objects, peer, &replicaSet, podFromReplicaSet(replicaSet, fmt.Sprintf("old%d", i)))
+	}
+	return &EtcdPeerReconciler{
+		Client:        fake.NewFakeClientWithScheme(scheme, objects...),
+		Log:           logf.NullLogger{},
+		EtcdImage:     restartTestImage,
+		ClusterDomain: "cluster.local",
+		Recorder:      record.NewFakeRecorder(10),
+		EtcdClients: etcd.NewClients(etcd.ClientOptions{
+			// Every member is served by the fake.
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+			},
+		}),
+	}
+}
+
+func getPeerPod(t *testing.T, r *EtcdPeerReconciler, name string) *corev1.Pod {
+	pods, err := r.clusterPods(context.Background(), *restartTestPeer(name, "", false))
+	require.NoError(t, err)
+	return pods[name]
+}
+
+func TestReplaceOutdatedPod_WithChangedSpec_RunsItInANewPod(t *testing.T) {
+	server := fakeMemberList(0xa, 0xb, 0xc)
+	defer server.Close()
+	r := restartTestReconciler(t, server,
+		restartTestPeer("bees-0", "a", true),
+		restartTestPeer("bees-1", "b", true),
+		restartTestPeer("bees-2", "c", true),
+	)
+	ctx := context.Background()
+
+	changed := restartTestPeer("bees-0", "a", true)
+	changed.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{
+		NodeSelector: map[string]string{"dedicated": "etcd"},
+	}
+	var replicaSet appsv1.ReplicaSet
+	key := client.ObjectKey{Namespace: "default", Name: "bees-0"}
+	require.NoError(t, r.Get(ctx, key, &replicaSet))
+	require.NoError(t, r.updateReplicaSet(ctx, logf.NullLogger{}, *changed, replicaSet))
+	require.NoError(t, r.replaceOutdatedPod(ctx, logf.NullLogger{}, *changed))
+	require.Nil(t, getPeerPod(t, r, "bees-0"), "the outdated pod should have been deleted")
+
+	// The ReplicaSet recreates the pod from the updated template.
+	require.NoError(t, r.Get(ctx, key, &replicaSet))
+	require.NoError(t, r.Create(ctx, podFromReplicaSet(replicaSet, "new0")))
+	pod := getPeerPod(t, r, "bees-0")
+	require.NotNil(t, pod)
+	require.Equal(t, "etcd", pod.Spec.NodeSelector["dedicated"])
+	hash := defineReplicaSet(*changed, restartTestImage, "cluster.local").Annotations[podTemplateHashAnnotation]
+	require.Equal(t, hash, pod.Annotations[podTemplateHashAnnotation])
+
+	// The new pod is current, so it is left alone.
+	require.NoError(t, r.replaceOutdatedPod(ctx, logf.NullLogger{}, *changed))
+	require.NotNil(t, getPeerPod(t, r, "bees-0"))
+}
+
+func TestReplaceOutdatedPod_WhileAnotherIsReplaced_KeepsPod(t *testing.T) {
+	server := fakeMemberList(0xa, 0xb, 0xc)
+	defer server.Close()
+	r := restartTestReconciler(t, server,
+		restartTestPeer("bees-0", "a", true),
+		restartTestPeer("bees-1", "b", true),
+		restartTestPeer("bees-2", "c", true),
+	)
+	ctx := context.Background()
+
+	changed0 := restartTestPeer("bees-0", "a", true)
+	changed0.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{PriorityClassName: "etcd-critical"}
+	changed1 := restartTestPeer("bees-1", "b", true)
+	changed1.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{PriorityClassName: "etcd-critical"}
+
+	require.NoError(t, r.replaceOutdatedPod(ctx, logf.NullLogger{}, *changed0))
+	require.Nil(t, getPeerPod(t, r, "bees-0"))
+
+	// bees-0 has no pod yet, and the recorded replacement is not finished.
+	require.NoError(t, r.replaceOutdatedPod(ctx, logf.NullLogger{}, *changed1))
+	require.NotNil(t, getPeerPod(t, r, "bees-1"))
+
+	// Once bees-0 is running again bees-1 is replaced.
+	replicaSet := defineReplicaSet(*changed0, restartTestImage, "cluster.local")
+	require.NoError(t, r.Create(ctx, podFromReplicaSet(replicaSet, "new0")))
+	require.NoError(t, r.replaceOutdatedPod(ctx, logf.NullLogger{}, *changed1))
+	require.Nil(t, getPeerPod(t, r, "bees-1"))
+}
+
+func TestReplaceOutdatedPod_WithUnreadyPeer_KeepsPod(t *testing.T) {
+	server := fakeMemberList(0xa, 0xb, 0xc)
+	defer server.Close()
+	r := restartTestReconciler(t, server,
+		restartTestPeer("bees-0", "a", true),
+		restartTestPeer("bees-1", "b", true),
+		restartTestPeer("bees-2", "c", false),
+	)
+
+	changed := restartTestPeer("bees-0", "a", true)
+	changed.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{PriorityClassName: "etcd-critical"}
+	require.NoError(t, r.replaceOutdatedPod(context.Background(), logf.NullLogger{}, *changed))
+	require.NotNil(t, getPeerPod(t, r, "bees-0"))
+}
+
+func TestReplaceOutdatedPod_WithoutQuorum_KeepsPod(t *testing.T) {
+	// The members without an EtcdPeer aren't known to be healthy. Without
+	// bees-0 only two of the remaining four voters are.
+	server := fakeMemberList(0xa, 0xb, 0xc, 0xd, 0xe)
+	defer server.Close()
+	r := restartTestReconciler(t, server,
+		restartTestPeer("bees-0", "a", true),
+		restartTestPeer("bees-1", "b", true),
+		restartTestPeer("bees-2", "c", true),
+	)
+
+	changed := restartTestPeer("bees-0", "a", true)
+	changed.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{PriorityClassName: "etcd-critical"}
+	require.NoError(t, r.replaceOutdatedPod(context.Background(), logf.NullLogger{}, *changed))
+	require.NotNil(t, getPeerPod(t, r, "bees-0"))
+}
+
+func TestReplaceOutdatedPod_WithOnlyPeer_KeepsPod(t *testing.T) {
+	server := fakeMemberList(0xa)
+	defer server.Close()
+	r := restartTestReconciler(t, server, restartTestPeer("bees-0", "a", true))
+
+	changed := restartTestPeer("bees-0", "a", true)
+	changed.Spec.PodTemplate = &etcdv1alpha1.EtcdPodTemplateSpec{PriorityClassName: "etcd-critical"}
+	require.NoError(t, r.replaceOutdatedPod(context.Background(), logf.NullLogger{}, *changed))
+	require.NotNil(t, getPeerPod(t, r, "bees-0"))
+}
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
+)
+
+const (
+	// statusRefreshInterval is how often the status of a peer is refreshed
+	// from its etcd member when nothing else causes a reconcile.
+	statusRefreshInterval = 30 * time.Second
+
+	reasonPodNotFound     = "PodNotFound"
+	reasonPodNotReady     = "PodNotReady"
+	reasonMemberUnhealthy = "MemberUnhealthy"
+	reasonMemberHealthy   = "MemberHealthy"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;delete
+
+// memberClient returns an HTTP client for talking to the peer's etcd member.
+// When the member serves clients over TLS the peer's client certificate is
+// presented to it, and the CA alongside it is used to verify the member.
+func (r *EtcdPeerReconciler) memberClient(ctx context.Context, peer etcdv1alpha1.EtcdPeer) (*http.Client, error) {
+	secretName := peer.ClientTLSSecretName()
+	if secretName == "" {
+		return r.EtcdClients.Get(nil)
+	}
+
+	var secret corev1.Secret
+	if err := r.APIReader.Get(ctx, client.ObjectKey{Namespace: peer.Namespace, Name: secretName}, &secret); err != nil {
+		return nil, err
+	}
+	httpClient, err := r.EtcdClients.Get(&etcd.TLSMaterial{
+		CertPEM:    secret.Data[corev1.TLSCertKey],
+		KeyPEM:     secret.Data[corev1.TLSPrivateKeyKey],
+		CAPEM:      secret.Data[tlsCAKey],
+		ServerName: advertiseHost(peer, r.ClusterDomain),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificates from secret %q: %w", secretName, err)
+	}
+	return httpClient, nil
+}
+
+// findPeerPod returns the pod running the peer, or nil if there isn't one.
+func (r *EtcdPeerReconciler) findPeerPod(ctx context.Context, peer etcdv1alpha1.EtcdPeer) (*corev1.Pod, error) {
+	var pods corev1.PodList
+	err := r.List(ctx, &pods,
+		client.InNamespace(peer.Namespace),
+		client.MatchingLabels{
+			appLabel:     appName,
+			clusterLabel: peer.Spec.ClusterName,
+			peerLabel:    peer.Name,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if pods.Items[i].DeletionTimestamp == nil {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// podClientEndpoint returns the URL on which the etcd member in the peer's pod
+// serves clients.
+func podClientEndpoint(peer etcdv1alpha1.EtcdPeer, pod *corev1.Pod) *url.URL {
+	return &url.URL{
+		Scheme: peer.ClientScheme(),
+		Host:   net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(etcdClientPort)),
+	}
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// isPeerReady reports whether the peer's last recorded status was ready.
+func isPeerReady(peer etcdv1alpha1.EtcdPeer) bool {
+	for _, condition := range peer.Status.Conditions {
+		if condition.Type == etcdv1alpha1.EtcdPeerReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// setPeerCondition adds or replaces the condition of the same type. The
+// transition time is only moved on when the condition's status changes.
+func setPeerCondition(status *etcdv1alpha1.EtcdPeerStatus, condition etcdv1alpha1.EtcdPeerCondition) {
+	for i, existing := range status.Conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		status.Conditions[i] = condition
+		return
+	}
+	status.Conditions = append(status.Conditions, condition)
+}
+
+// observePeer works out whether the peer is ready from its pod and from the
+// etcd member in it. What the member reports about itself is recorded in
+// `status`. The values already there are kept when it can't be reached.
+func (r *EtcdPeerReconciler) observePeer(ctx context.Context, log logr.Logger, peer etcdv1alpha1.EtcdPeer, status *etcdv1alpha1.EtcdPeerStatus) (etcdv1alpha1.EtcdPeerCondition, error) {
+	ready := etcdv1alpha1.EtcdPeerCondition{
+		Type:               etcdv1alpha1.EtcdPeerReady,
+		Status:             corev1.ConditionFalse,
+		LastTransitionTime: metav1.Now(),
+	}
+
+	pod, err := r.findPeerPod(ctx, peer)
+	if err != nil {
+		return ready, err
+	}
+	if pod == nil {
+		ready.Reason = reasonPodNotFound
+		ready.Message = "No pod is running for the peer"
+		return ready, nil
+	}
+	if !isPodReady(pod) || pod.Status.PodIP == "" {
+		ready.Reason = reasonPodNotReady
+		ready.Message = fmt.Sprintf("Pod %s is not ready", pod.Name)
+		return ready, nil
+	}
+
+	httpClient, err := r.memberClient(ctx, peer)
+	if err != nil {
+		return ready, err
+	}
+	member, err := etcd.FetchMemberStatus(ctx, httpClient, podClientEndpoint(peer, pod))
+	if err != nil {
+		log.V(1).Info("Unable to query etcd member", "error", err.Error())
+		ready.Status = corev1.ConditionUnknown
+		ready.Reason = reasonMemberUnhealthy
+		ready.Message = err.Error()
+		return ready, nil
+	}
+
+	clusterLeaders.observe(client.ObjectKey{Namespace: peer.Namespace, Name: peer.Name}, peer.Spec.ClusterName, member.Leader, member.RaftTerm)
+	status.MemberID = strconv.FormatUint(member.MemberID, 16)
+	status.Version = member.Version
+	status.DBSize = resource.NewQuantity(member.DBSize, resource.BinarySI)
+	if member.Healthy {
+		ready.Status = corev1.ConditionTrue
+		ready.Reason = reasonMemberHealthy
+		ready.Message = "etcd member is healthy"
+	} else {
+		ready.Reason = reasonMemberUnhealthy
+		ready.Message = "etcd member reports that it is unhealthy"
+	}
+	return ready, nil
+}
+
+// recordReadyTransition records an Event when the peer becomes ready, or stops
+// being ready, so that changes in the member's health are visible alongside
+// the other actions taken for the peer.
+func (r *EtcdPeerReconciler) recordReadyTransition(peer *etcdv1alpha1.EtcdPeer, ready etcdv1alpha1.EtcdPeerCondition) {
+	wasReady := false
+	for _, condition := range peer.Status.Conditions {
+		if condition.Type == etcdv1alpha1.EtcdPeerReady {
+			wasReady = condition.Status == corev1.ConditionTrue
+		}
+	}
+	isReady := ready.Status == corev1.ConditionTrue
+	switch {
+	case isReady && !wasReady:
+		r.Recorder.Event(peer, corev1.EventTypeNormal, eventReasonMemberReady, ready.Message)
+	case wasReady && !isReady:
+		r.Recorder.Event(peer, corev1.EventTypeWarning, eventReasonMemberNotReady, ready.Message)
+	}
+}
+
+// updatePeerStatus refreshes the status of the peer, writing it back only if
+// it has changed.
+func (r *EtcdPeerReconciler) updatePeerStatus(ctx context.Context, log logr.Logger, peer etcdv1alpha1.EtcdPeer) error {
+	status := peer.Status.DeepCopy()
+	ready, err := r.observePeer(ctx, log, peer, status)
+	if err != nil {
+		log.Error(err, "unable to observe EtcdPeer status")
+		return err
+	}
+	r.recordReadyTransition(&peer, ready)
+	setPeerCondition(status, ready)
+
+	if apiequality.Semantic.DeepEqual(*status, peer.Status) {
+		return nil
+	}
+	peer.Status = *status
+	if err := r.Status().Update(ctx, &peer); err != nil {
+		log.Error(err, "unable to update EtcdPeer status")
+		return err
+	}
+	return nil
+}
+
+// podToPeerRequest maps a pod to the EtcdPeer that it is running, so that
+// the peer's status is refreshed when its pod changes.
+var podToPeerRequest = handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+	peerName, ok := o.Meta.GetLabels()[peerLabel]
+	if !ok || o.Meta.GetLabels()[appLabel] != appName {
+		return nil
+	}
+	return []reconcile.Request{
+		{NamespacedName: client.ObjectKey{Namespace: o.Meta.GetNamespace(), Name: peerName}},
+	}
+})
@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+func TestSetPeerCondition_WithSameStatus_KeepsTransitionTime(t *testing.T) {
+	then := metav1.NewTime(time.Now().Add(-time.Hour))
+	status := etcdv1alpha1.EtcdPeerStatus{
+		Conditions: []etcdv1alpha1.EtcdPeerCondition{
+			{
+				Type:               etcdv1alpha1.EtcdPeerReady,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: then,
+			},
+		},
+	}
+
+	setPeerCondition(&status, etcdv1alpha1.EtcdPeerCondition{
+		Type:               etcdv1alpha1.EtcdPeerReady,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reasonMemberHealthy,
+	})
+	require.Len(t, status.Conditions, 1)
+	require.Equal(t, then, status.Conditions[0].LastTransitionTime)
+	require.Equal(t, reasonMemberHealthy, status.Conditions[0].Reason)
+
+	now := metav1.Now()
+	setPeerCondition(&status, etcdv1alpha1.EtcdPeerCondition{
+		Type:               etcdv1alpha1.EtcdPeerReady,
+		Status:             corev1.ConditionFalse,
+		LastTransitionTime: now,
+	})
+	require.Len(t, status.Conditions, 1)
+	require.Equal(t, now, status.Conditions[0].LastTransitionTime)
+}
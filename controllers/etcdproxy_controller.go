@@ -0,0 +1,405 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+// EtcdProxyReconciler reconciles a EtcdProxy object
+type EtcdProxyReconciler struct {
+	client.Client
+	Log logr.Logger
+
+	// EtcdImage is the image used for the proxy container. The gRPC proxy
+	// is part of the etcd binary.
+	EtcdImage string
+	// ReconcileTimeout is how long a single reconcile may take.
+	ReconcileTimeout time.Duration
+	// ClusterDomain is the DNS domain of the Kubernetes cluster, which
+	// qualifies the host names that peers advertise.
+	ClusterDomain string
+	// Recorder records Events against the EtcdProxy for the actions taken
+	// on its behalf.
+	Recorder record.EventRecorder
+}
+
+const (
+	proxyAppName          = "etcd-proxy"
+	proxyLabel            = "etcd.improbable.io/proxy-name"
+	defaultProxyReplicas  = 1
+	proxyContainerName    = "etcd-proxy"
+	proxyServicePortName  = "client"
+	proxyReadinessTimeout = 5
+)
+
+// Reasons used for the Events recorded against an EtcdProxy.
+const (
+	eventReasonDeploymentCreated = "DeploymentCreated"
+	eventReasonDeploymentUpdated = "DeploymentUpdated"
+	eventReasonServiceCreated    = "ServiceCreated"
+	eventReasonNoEndpoints       = "NoEndpoints"
+)
+
+// +kubebuilder:rbac:groups=etcd.improbable.io,resources=etcdproxies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=etcd.improbable.io,resources=etcdproxies/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;patch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;patch
+
+// proxyLabels are the labels of the proxy's Deployment, pods and Service. The
+// app label differs from that of the peers so that proxies are not counted as
+// members, and are only let through the peers' NetworkPolicies as clients.
+func proxyLabels(proxy etcdv1alpha1.EtcdProxy) map[string]string {
+	return map[string]string{
+		appLabel:     proxyAppName,
+		clusterLabel: proxy.Spec.ClusterName,
+		proxyLabel:   proxy.Name,
+	}
+}
+
+// proxyEndpoints returns the client URLs of the peers that the proxy forwards
+// to, in a stable order so that the Deployment only changes when the peers do.
+func proxyEndpoints(peers []etcdv1alpha1.EtcdPeer, clusterDomain string) []string {
+	endpoints := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		endpoints = append(endpoints, advertiseURL(peer, clusterDomain, peer.ClientScheme(), etcdClientPort).String())
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+// defineProxyDeployment builds the Deployment which runs `etcd grpc-proxy` in
+// front of the given endpoints. The proxy takes host:port endpoints, and uses
+// TLS to reach them when it is given a client certificate.
+func defineProxyDeployment(proxy etcdv1alpha1.EtcdProxy, endpoints []string, image string) appsv1.Deployment {
+	var replicas int32 = defaultProxyReplicas
+	if proxy.Spec.Replicas != nil {
+		replicas = *proxy.Spec.Replicas
+	}
+	labels := proxyLabels(proxy)
+
+	hosts := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		// The endpoints are built by proxyEndpoints, so always parse.
+		u, _ := url.Parse(endpoint)
+		hosts = append(hosts, u.Host)
+	}
+	args := []string{
+		"grpc-proxy",
+		"start",
+		"--endpoints=" + strings.Join(hosts, ","),
+		fmt.Sprintf("--listen-addr=0.0.0.0:%d", etcdClientPort),
+	}
+
+	var volumes []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	if proxy.Spec.ClientSecretName != "" {
+		args = append(args,
+			"--cert="+path.Join(clientTLSMountPath, corev1.TLSCertKey),
+			"--key="+path.Join(clientTLSMountPath, corev1.TLSPrivateKeyKey),
+			"--cacert="+path.Join(clientTLSMountPath, tlsCAKey),
+		)
+		volumes = append(volumes, corev1.Volume{
+			Name: clientTLSVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: proxy.Spec.ClientSecretName},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      clientTLSVolumeName,
+			MountPath: clientTLSMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	var resources corev1.ResourceRequirements
+	if proxy.Spec.Resources != nil {
+		resources = *proxy.Spec.Resources
+	}
+
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:          labels,
+			Annotations:     make(map[string]string),
+			Name:            proxy.Name,
+			Namespace:       proxy.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(&proxy, etcdv1alpha1.GroupVersion.WithKind("EtcdProxy"))},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: make(map[string]string),
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    proxyContainerName,
+							Image:   image,
+							Command: []string{etcdBinary},
+							Args:    args,
+							Ports: []corev1.ContainerPort{
+								{Name: proxyServicePortName, ContainerPort: etcdClientPort, Protocol: corev1.ProtocolTCP},
+							},
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(etcdClientPort)},
+								},
+								TimeoutSeconds: proxyReadinessTimeout,
+							},
+							Resources:    resources,
+							VolumeMounts: volumeMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+
+	hash := podTemplateHash(deployment.Spec.Template)
+	deployment.Annotations[podTemplateHashAnnotation] = hash
+	deployment.Spec.Template.Annotations[podTemplateHashAnnotation] = hash
+	return deployment
+}
+
+// defineProxyService builds the Service through which clients reach the
+// proxy's pods.
+func defineProxyService(proxy etcdv1alpha1.EtcdProxy) corev1.Service {
+	labels := proxyLabels(proxy)
+	return corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:          labels,
+			Name:            proxy.Name,
+			Namespace:       proxy.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(&proxy, etcdv1alpha1.GroupVersion.WithKind("EtcdProxy"))},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       proxyServicePortName,
+					Protocol:   corev1.ProtocolTCP,
+					Port:       etcdClientPort,
+					TargetPort: intstr.FromString(proxyServicePortName),
+				},
+			},
+		},
+	}
+}
+
+func (r *EtcdProxyReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.ReconcileTimeout)
+	defer cancel()
+
+	log := r.Log.WithValues("etcdproxy", req.NamespacedName)
+
+	var proxy etcdv1alpha1.EtcdProxy
+	if err := r.Get(ctx, req.NamespacedName, &proxy); err != nil {
+		log.Error(err, "unable to fetch EtcdProxy")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	var peers etcdv1alpha1.EtcdPeerList
+	if err := r.List(ctx, &peers, client.InNamespace(proxy.Namespace)); err != nil {
+		log.Error(err, "unable to list EtcdPeers")
+		return ctrl.Result{}, err
+	}
+	var clusterPeers []etcdv1alpha1.EtcdPeer
+	for _, peer := range peers.Items {
+		if peer.Spec.ClusterName == proxy.Spec.ClusterName && peer.DeletionTimestamp == nil {
+			clusterPeers = append(clusterPeers, peer)
+		}
+	}
+	if len(clusterPeers) == 0 {
+		// There's nothing to forward to. Leave any existing Deployment
+		// alone, the proxy can't be pointed at an empty list of members.
+		log.V(1).Info("No EtcdPeers found for cluster", "cluster", proxy.Spec.ClusterName)
+		r.Recorder.Eventf(&proxy, corev1.EventTypeWarning, eventReasonNoEndpoints,
+			"No EtcdPeers found for cluster %s", proxy.Spec.ClusterName)
+		return ctrl.Result{}, nil
+	}
+	endpoints := proxyEndpoints(clusterPeers, r.ClusterDomain)
+
+	if err := r.reconcileProxyService(ctx, log, proxy); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	deployment, err := r.reconcileProxyDeployment(ctx, log, proxy, endpoints)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := etcdv1alpha1.EtcdProxyStatus{
+		Replicas:      deployment.Status.Replicas,
+		ReadyReplicas: deployment.Status.ReadyReplicas,
+		Endpoints:     endpoints,
+	}
+	if apiequality.Semantic.DeepEqual(proxy.Status, status) {
+		return ctrl.Result{}, nil
+	}
+	proxy.Status = status
+	if err := r.Status().Update(ctx, &proxy); err != nil {
+		log.Error(err, "unable to update EtcdProxy status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// deploymentDrifted reports whether the replica count, pod template hash or pod
+// template set by defineProxyDeployment differ on the existing Deployment, so
+// that edits made to the Deployment by someone else are undone too. Fields
+// which were defaulted by the API server are ignored.
+func deploymentDrifted(existing, desired appsv1.Deployment) bool {
+	if !apiequality.Semantic.DeepEqual(existing.Spec.Replicas, desired.Spec.Replicas) {
+		return true
+	}
+	if existing.Annotations[podTemplateHashAnnotation] != desired.Annotations[podTemplateHashAnnotation] {
+		return true
+	}
+	return podTemplateDrifted(existing.Spec.Template, desired.Spec.Template)
+}
+
+// reconcileProxyDeployment creates the proxy's Deployment if it is missing, and
+// patches it if its replicas or pod template are out of date. It returns the
+// Deployment as it is now, for its status.
+func (r *EtcdProxyReconciler) reconcileProxyDeployment(ctx context.Context, log logr.Logger, proxy etcdv1alpha1.EtcdProxy, endpoints []string) (appsv1.Deployment, error) {
+	desired := defineProxyDeployment(proxy, endpoints, r.EtcdImage)
+
+	var existing appsv1.Deployment
+	err := r.Get(ctx, client.ObjectKey{Namespace: proxy.Namespace, Name: proxy.Name}, &existing)
+	if apierrs.IsNotFound(err) {
+		log.V(1).Info("Deployment does not exist, creating")
+		if err := r.Create(ctx, &desired); err != nil {
+			log.Error(err, "unable to create Deployment for EtcdProxy", "deployment", desired.Name)
+			r.Recorder.Eventf(&proxy, corev1.EventTypeWarning, eventReasonCreateFailed,
+				"Failed to create Deployment %s: %s", desired.Name, err)
+			return desired, err
+		}
+		r.Recorder.Eventf(&proxy, corev1.EventTypeNormal, eventReasonDeploymentCreated,
+			"Created Deployment %s", desired.Name)
+		return desired, nil
+	}
+	if err != nil {
+		log.Error(err, "unable to query for deployments")
+		return existing, err
+	}
+
+	if !deploymentDrifted(existing, desired) {
+		return existing, nil
+	}
+
+	hash := desired.Annotations[podTemplateHashAnnotation]
+	log.V(1).Info("Deployment is out of date, patching", "podTemplateHash", hash)
+	patch := client.MergeFrom(existing.DeepCopy())
+	existing.Spec.Replicas = desired.Spec.Replicas
+	existing.Spec.Template = desired.Spec.Template
+	if existing.Annotations == nil {
+		existing.Annotations = make(map[string]string)
+	}
+	existing.Annotations[podTemplateHashAnnotation] = hash
+	if err := r.Patch(ctx, &existing, patch); err != nil {
+		log.Error(err, "unable to patch Deployment for EtcdProxy", "deployment", existing.Name)
+		return existing, err
+	}
+	r.Recorder.Eventf(&proxy, corev1.EventTypeNormal, eventReasonDeploymentUpdated,
+		"Updated Deployment %s", existing.Name)
+	return existing, nil
+}
+
+// reconcileProxyService creates the proxy's Service if it is missing, and
+// patches its selector and ports back if they have drifted.
+func (r *EtcdProxyReconciler) reconcileProxyService(ctx context.Context, log logr.Logger, proxy etcdv1alpha1.EtcdProxy) error {
+	desired := defineProxyService(proxy)
+
+	var existing corev1.Service
+	err := r.Get(ctx, client.ObjectKey{Namespace: proxy.Namespace, Name: proxy.Name}, &existing)
+	if apierrs.IsNotFound(err) {
+		log.V(1).Info("Service does not exist, creating")
+		if err := r.Create(ctx, &desired); err != nil {
+			log.Error(err, "unable to create Service for EtcdProxy", "service", desired.Name)
+			r.Recorder.Eventf(&proxy, corev1.EventTypeWarning, eventReasonCreateFailed,
+				"Failed to create Service %s: %s", desired.Name, err)
+			return err
+		}
+		r.Recorder.Eventf(&proxy, corev1.EventTypeNormal, eventReasonServiceCreated,
+			"Created Service %s", desired.Name)
+		return nil
+	}
+	if err != nil {
+		log.Error(err, "unable to query for services")
+		return err
+	}
+
+	if apiequality.Semantic.DeepEqual(existing.Spec.Selector, desired.Spec.Selector) &&
+		apiequality.Semantic.DeepEqual(existing.Spec.Ports, desired.Spec.Ports) {
+		return nil
+	}
+	log.V(1).Info("Service has drifted, patching")
+	patch := client.MergeFrom(existing.DeepCopy())
+	existing.Spec.Selector = desired.Spec.Selector
+	existing.Spec.Ports = desired.Spec.Ports
+	if err := r.Patch(ctx, &existing, patch); err != nil {
+		log.Error(err, "unable to patch Service for EtcdProxy", "service", existing.Name)
+		return err
+	}
+	return nil
+}
+
+// peerToProxyRequests maps an EtcdPeer to the EtcdProxies of its cluster, so
+// that proxies follow peers being added and removed.
+func (r *EtcdProxyReconciler) peerToProxyRequests(o handler.MapObject) []reconcile.Request {
+	peer, ok := o.Object.(*etcdv1alpha1.EtcdPeer)
+	if !ok {
+		return nil
+	}
+	var proxies etcdv1alpha1.EtcdProxyList
+	if err := r.List(context.Background(), &proxies, client.InNamespace(peer.Namespace)); err != nil {
+		r.Log.Error(err, "unable to list EtcdProxies", "namespace", peer.Namespace)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, proxy := range proxies.Items {
+		if proxy.Spec.ClusterName == peer.Spec.ClusterName {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKey{Namespace: proxy.Namespace, Name: proxy.Name},
+			})
+		}
+	}
+	return requests
+}
+
+func (r *EtcdProxyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&etcdv1alpha1.EtcdProxy{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		// Follow the peers of the proxied cluster.
+		Watches(
+			&source.Kind{Type: &etcdv1alpha1.EtcdPeer{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.peerToProxyRequests)},
+		).
+		Complete(r)
+}
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+func exampleProxy() etcdv1alpha1.EtcdProxy {
+	return etcdv1alpha1.EtcdProxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-cluster-proxy", Namespace: "default"},
+		Spec:       etcdv1alpha1.EtcdProxySpec{ClusterName: "my-cluster"},
+	}
+}
+
+func TestProxyEndpoints_ReturnsSortedClientURLs(t *testing.T) {
+	peer := func(name string) etcdv1alpha1.EtcdPeer {
+		return etcdv1alpha1.EtcdPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       etcdv1alpha1.EtcdPeerSpec{ClusterName: "my-cluster"},
+		}
+	}
+
+	endpoints := proxyEndpoints([]etcdv1alpha1.EtcdPeer{peer("magic"), peer("bees")}, "cluster.local")
+	require.Equal(t, []string{
+		"http://bees.my-cluster.default.svc.cluster.local:2379",
+		"http://magic.my-cluster.default.svc.cluster.local:2379",
+	}, endpoints)
+}
+
+func TestDefineProxyDeployment_PassesEndpointsAsHostPorts(t *testing.T) {
+	deployment := defineProxyDeployment(exampleProxy(), []string{
+		"https://bees.my-cluster.default.svc.cluster.local:2379",
+		"https://magic.my-cluster.default.svc.cluster.local:2379",
+	}, "quay.io/coreos/etcd:v3.2.27")
+
+	require.Equal(t, int32(1), *deployment.Spec.Replicas)
+	container := deployment.Spec.Template.Spec.Containers[0]
+	require.Equal(t, "quay.io/coreos/etcd:v3.2.27", container.Image)
+	require.Equal(t, []string{
+		"grpc-proxy",
+		"start",
+		"--endpoints=bees.my-cluster.default.svc.cluster.local:2379,magic.my-cluster.default.svc.cluster.local:2379",
+		"--listen-addr=0.0.0.0:2379",
+	}, container.Args)
+	require.Empty(t, deployment.Spec.Template.Spec.Volumes)
+}
+
+func TestDefineProxyDeployment_WithClientSecret_MountsItForTLS(t *testing.T) {
+	proxy := exampleProxy()
+	proxy.Spec.ClientSecretName = "my-cluster-client"
+
+	deployment := defineProxyDeployment(proxy, []string{"https://bees.my-cluster.default.svc.cluster.local:2379"}, "quay.io/coreos/etcd:v3.2.27")
+
+	container := deployment.Spec.Template.Spec.Containers[0]
+	require.Contains(t, container.Args, "--cert=/etc/etcd/tls/client/tls.crt")
+	require.Contains(t, container.Args, "--key=/etc/etcd/tls/client/tls.key")
+	require.Contains(t, container.Args, "--cacert=/etc/etcd/tls/client/ca.crt")
+	require.Equal(t, "my-cluster-client", deployment.Spec.Template.Spec.Volumes[0].Secret.SecretName)
+	require.Equal(t, "/etc/etcd/tls/client", container.VolumeMounts[0].MountPath)
+}
+
+func TestDefineProxyDeployment_LabelsAreNotThoseOfPeers(t *testing.T) {
+	deployment := defineProxyDeployment(exampleProxy(), []string{"http://bees.my-cluster.default.svc.cluster.local:2379"}, "quay.io/coreos/etcd:v3.2.27")
+
+	labels := deployment.Spec.Template.Labels
+	require.NotEqual(t, appName, labels[appLabel])
+	require.NotContains(t, labels, peerLabel)
+	require.Equal(t, "my-cluster-proxy", labels[proxyLabel])
+}
+
+func TestDefineProxyDeployment_EndpointsChange_PodTemplateHashChanges(t *testing.T) {
+	before := defineProxyDeployment(exampleProxy(), []string{"http://bees.my-cluster.default.svc.cluster.local:2379"}, "quay.io/coreos/etcd:v3.2.27")
+	after := defineProxyDeployment(exampleProxy(), []string{
+		"http://bees.my-cluster.default.svc.cluster.local:2379",
+		"http://magic.my-cluster.default.svc.cluster.local:2379",
+	}, "quay.io/coreos/etcd:v3.2.27")
+
+	require.NotEqual(t, before.Annotations[podTemplateHashAnnotation], after.Annotations[podTemplateHashAnnotation])
+}
+
+func TestDefineProxyService_SelectsProxyPods(t *testing.T) {
+	proxy := exampleProxy()
+	service := defineProxyService(proxy)
+	deployment := defineProxyDeployment(proxy, []string{"http://bees.my-cluster.default.svc.cluster.local:2379"}, "quay.io/coreos/etcd:v3.2.27")
+
+	require.Equal(t, deployment.Spec.Template.Labels, service.Spec.Selector)
+	require.Equal(t, int32(2379), service.Spec.Ports[0].Port)
+}
+
+func TestDeploymentDrifted(t *testing.T) {
+	desired := defineProxyDeployment(exampleProxy(), []string{"http://bees.my-cluster.default.svc.cluster.local:2379"}, "quay.io/coreos/etcd:v3.2.27")
+
+	t.Run("WithDefaultedFields_IsFalse", func(t *testing.T) {
+		existing := *desired.DeepCopy()
+		existing.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+		existing.Spec.Template.Spec.Containers[0].TerminationMessagePath = "/dev/termination-log"
+		require.False(t, deploymentDrifted(existing, desired))
+	})
+
+	t.Run("WithEditedTemplate_IsTrue", func(t *testing.T) {
+		// The hash annotation is unchanged, as it is when someone edits
+		// the Deployment.
+		existing := *desired.DeepCopy()
+		existing.Spec.Template.Spec.Containers[0].Image = "quay.io/coreos/etcd:v3.4.3"
+		require.True(t, deploymentDrifted(existing, desired))
+	})
+
+	t.Run("WithChangedReplicas_IsTrue", func(t *testing.T) {
+		existing := *desired.DeepCopy()
+		replicas := int32(3)
+		existing.Spec.Replicas = &replicas
+		require.True(t, deploymentDrifted(existing, desired))
+	})
+}
+
+func TestReconcileProxy_PeerAddedAndRemoved_UpdatesEndpoints(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, etcdv1alpha1.AddToScheme(scheme))
+
+	peer := func(name string) *etcdv1alpha1.EtcdPeer {
+		return &etcdv1alpha1.EtcdPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       etcdv1alpha1.EtcdPeerSpec{ClusterName: "my-cluster"},
+		}
+	}
+	proxy := exampleProxy()
+	r := &EtcdProxyReconciler{
+		Client:           fake.NewFakeClientWithScheme(scheme, &proxy, peer("bees")),
+		Log:              logf.NullLogger{},
+		EtcdImage:        "quay.io/coreos/etcd:v3.2.27",
+		ReconcileTimeout: time.Minute,
+		ClusterDomain:    "cluster.local",
+		Recorder:         record.NewFakeRecorder(10),
+	}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "my-cluster-proxy"}}
+
+	requireEndpoints := func(hosts string, endpoints ...string) {
+		t.Helper()
+		_, err := r.Reconcile(req)
+		require.NoError(t, err)
+
+		var deployment appsv1.Deployment
+		require.NoError(t, r.Get(ctx, req.NamespacedName, &deployment))
+		require.Contains(t, deployment.Spec.Template.Spec.Containers[0].Args, "--endpoints="+hosts)
+		var updated etcdv1alpha1.EtcdProxy
+		require.NoError(t, r.Get(ctx, req.NamespacedName, &updated))
+		require.Equal(t, endpoints, updated.Status.Endpoints)
+	}
+
+	requireEndpoints("bees.my-cluster.default.svc.cluster.local:2379",
+		"http://bees.my-cluster.default.svc.cluster.local:2379")
+
+	require.NoError(t, r.Create(ctx, peer("magic")))
+	requireEndpoints("bees.my-cluster.default.svc.cluster.local:2379,magic.my-cluster.default.svc.cluster.local:2379",
+		"http://bees.my-cluster.default.svc.cluster.local:2379",
+		"http://magic.my-cluster.default.svc.cluster.local:2379")
+
+	require.NoError(t, r.Delete(ctx, peer("bees")))
+	requireEndpoints("magic.my-cluster.default.svc.cluster.local:2379",
+		"http://magic.my-cluster.default.svc.cluster.local:2379")
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+// Reconcile counts, errors and durations per controller are already exported
+// by controller-runtime as `controller_runtime_reconcile_*`. The metrics here
+// describe the etcd clusters themselves.
+
+const (
+	metricsNamespace = "etcd_cluster_operator"
+	// metricsListTimeout bounds the listing of peers done for each scrape.
+	metricsListTimeout = 5 * time.Second
+)
+
+var (
+	clusterPeersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "cluster", "peers"),
+		"Number of EtcdPeers in the cluster.",
+		[]string{"namespace", "cluster"}, nil,
+	)
+	clusterReadyPeersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "cluster", "ready_peers"),
+		"Number of EtcdPeers in the cluster whose member is ready and healthy.",
+		[]string{"namespace", "cluster"}, nil,
+	)
+
+	leaderChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "cluster",
+			Name:      "leader_changes_total",
+			Help:      "Number of changes of leader observed in the cluster.",
+		},
+		[]string{"namespace", "cluster"},
+	)
+)
+
+// clusterCollector reports the number of peers and ready peers of every
+// cluster, from the EtcdPeers in the cache at the time of the scrape. Working
+// this out on demand means that deleted clusters disappear from the metrics.
+type clusterCollector struct {
+	reader client.Reader
+}
+
+var _ prometheus.Collector = &clusterCollector{}
+
+func (c *clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clusterPeersDesc
+	ch <- clusterReadyPeersDesc
+}
+
+func (c *clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsListTimeout)
+	defer cancel()
+
+	var peers etcdv1alpha1.EtcdPeerList
+	if err := c.reader.List(ctx, &peers); err != nil {
+		ch <- prometheus.NewInvalidMetric(clusterPeersDesc, err)
+		return
+	}
+
+	total := map[clusterKey]int{}
+	ready := map[clusterKey]int{}
+	for _, peer := range peers.Items {
+		key := clusterKey{peer.Namespace, peer.Spec.ClusterName}
+		total[key]++
+		for _, condition := range peer.Status.Conditions {
+			if condition.Type == etcdv1alpha1.EtcdPeerReady && condition.Status == corev1.ConditionTrue {
+				ready[key]++
+			}
+		}
+	}
+	for key, count := range total {
+		ch <- prometheus.MustNewConstMetric(clusterPeersDesc, prometheus.GaugeValue, float64(count), key.namespace, key.cluster)
+		ch <- prometheus.MustNewConstMetric(clusterReadyPeersDesc, prometheus.GaugeValue, float64(ready[key]), key.namespace, key.cluster)
+	}
+}
+
+// leaderTracker remembers the last leader reported by any member of each
+// cluster, and the raft term it was elected in, so that changes of leader can
+// be counted. Clusters are forgotten when the last of their peers is deleted.
+type leaderTracker struct {
+	mu      sync.Mutex
+	leaders map[clusterKey]trackedLeader
+	// peers maps each peer which has reported a leader to its cluster.
+	peers map[types.NamespacedName]clusterKey
+}
+
+type clusterKey struct{ namespace, cluster string }
+
+type trackedLeader struct {
+	id   uint64
+	term uint64
+}
+
+var clusterLeaders = newLeaderTracker()
+
+func newLeaderTracker() *leaderTracker {
+	return &leaderTracker{
+		leaders: map[clusterKey]trackedLeader{},
+		peers:   map[types.NamespacedName]clusterKey{},
+	}
+}
+
+// observe records that the member of `peer` reported `leader`, elected in
+// raft term `term`. The first leader seen for a cluster isn't counted as a
+// change. Reports from earlier terms are ignored, so that a member which
+// hasn't heard of the latest election yet doesn't count the change again.
+func (t *leaderTracker) observe(peer types.NamespacedName, cluster string, leader, term uint64) {
+	if leader == 0 {
+		// The member doesn't know of a leader, e.g. during an election.
+		return
+	}
+	key := clusterKey{peer.Namespace, cluster}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers[peer] = key
+	previous, seen := t.leaders[key]
+	if seen && term < previous.term {
+		return
+	}
+	t.leaders[key] = trackedLeader{id: leader, term: term}
+	if seen && previous.id != leader {
+		leaderChanges.WithLabelValues(key.namespace, key.cluster).Inc()
+	}
+}
+
+// forget removes a deleted peer. When it was the last peer of its cluster
+// the cluster's leader, and its count of changes, are dropped too.
+func (t *leaderTracker) forget(peer types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, ok := t.peers[peer]
+	if !ok {
+		return
+	}
+	delete(t.peers, peer)
+	for _, other := range t.peers {
+		if other == key {
+			return
+		}
+	}
+	delete(t.leaders, key)
+	leaderChanges.DeleteLabelValues(key.namespace, key.cluster)
+}
+
+// RegisterMetrics registers the cluster metrics with the controller-runtime
+// registry, which is served on the manager's metrics address. `reader` is
+// used to list EtcdPeers at each scrape, normally the manager's cached client.
+func RegisterMetrics(reader client.Reader) error {
+	if err := metrics.Registry.Register(&clusterCollector{reader: reader}); err != nil {
+		return err
+	}
+	return metrics.Registry.Register(leaderChanges)
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestLeaderTracker_OnNewLeader_CountsChange(t *testing.T) {
+	tracker := newLeaderTracker()
+	changes := leaderChanges.WithLabelValues("default", "tracked")
+	before := testutil.ToFloat64(changes)
+	bees := types.NamespacedName{Namespace: "default", Name: "bees"}
+
+	// The first leader seen, the same leader again and no leader at all
+	// are not changes.
+	tracker.observe(bees, "tracked", 1, 2)
+	tracker.observe(bees, "tracked", 1, 2)
+	tracker.observe(bees, "tracked", 0, 3)
+	require.Equal(t, before, testutil.ToFloat64(changes))
+
+	tracker.observe(bees, "tracked", 2, 3)
+	require.Equal(t, before+1, testutil.ToFloat64(changes))
+
+	// Other clusters are tracked separately.
+	tracker.observe(types.NamespacedName{Namespace: "default", Name: "wasps"}, "other", 3, 1)
+	require.Equal(t, before+1, testutil.ToFloat64(changes))
+}
+
+func TestLeaderTracker_OnStaleReport_DoesNotCountAgain(t *testing.T) {
+	tracker := newLeaderTracker()
+	changes := leaderChanges.WithLabelValues("default", "stale")
+	before := testutil.ToFloat64(changes)
+	bees := types.NamespacedName{Namespace: "default", Name: "bees"}
+	magic := types.NamespacedName{Namespace: "default", Name: "magic"}
+
+	tracker.observe(bees, "stale", 1, 2)
+	tracker.observe(bees, "stale", 2, 3)
+	require.Equal(t, before+1, testutil.ToFloat64(changes))
+
+	// magic hasn't heard of the election yet, then catches up.
+	tracker.observe(magic, "stale", 1, 2)
+	tracker.observe(magic, "stale", 2, 3)
+	require.Equal(t, before+1, testutil.ToFloat64(changes))
+}
+
+func TestLeaderTracker_OnLastPeerForgotten_DropsCluster(t *testing.T) {
+	tracker := newLeaderTracker()
+	bees := types.NamespacedName{Namespace: "default", Name: "bees"}
+	magic := types.NamespacedName{Namespace: "default", Name: "magic"}
+	key := clusterKey{"default", "forgotten"}
+
+	tracker.observe(bees, "forgotten", 1, 2)
+	tracker.observe(magic, "forgotten", 1, 2)
+
+	tracker.forget(bees)
+	require.Contains(t, tracker.leaders, key)
+
+	tracker.forget(magic)
+	require.NotContains(t, tracker.leaders, key)
+	require.Empty(t, tracker.peers)
+}
@@ -15,6 +15,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 
 	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/config"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
 )
 
 type controllerSuite struct {
@@ -65,11 +67,19 @@ func (s controllerSuite) setupTest(t *testing.T) (teardownFunc func()) {
 	mgr, err := ctrl.NewManager(s.cfg, ctrl.Options{})
 	require.NoError(t, err, "failed to create manager")
 
+	operatorConfig := config.Default()
+
 	controller := EtcdPeerReconciler{
 		Client: mgr.GetClient(),
 		Log: logtest.TestLogger{
 			T: t,
 		},
+		APIReader:        mgr.GetAPIReader(),
+		EtcdImage:        operatorConfig.EtcdImage,
+		ReconcileTimeout: operatorConfig.ReconcileTimeout.Duration,
+		ClusterDomain:    operatorConfig.ClusterDomain,
+		Recorder:         mgr.GetEventRecorderFor("etcdpeer-controller"),
+		EtcdClients:      etcd.NewClients(etcd.ClientOptions{}),
 	}
 	err = controller.SetupWithManager(mgr)
 	require.NoError(t, err, "failed to set up EtcdPeer controller")
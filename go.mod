@@ -3,11 +3,15 @@ module github.com/improbable-eng/etcd-cluster-operator
 go 1.13
 
 require (
+	github.com/docker/spdystream v0.0.0-20160310174837-449fdfce4d96 // indirect
 	github.com/go-logr/logr v0.1.0
+	github.com/prometheus/client_golang v0.9.0
 	github.com/stretchr/testify v1.3.0
+	go.uber.org/zap v1.9.1
 	k8s.io/api v0.0.0-20190409021203-6e4e0e4f393b
 	k8s.io/apimachinery v0.0.0-20190404173353-6a84e37a896d
 	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
 	sigs.k8s.io/controller-runtime v0.2.2
 	sigs.k8s.io/controller-tools v0.2.1 // indirect
+	sigs.k8s.io/yaml v1.1.0
 )
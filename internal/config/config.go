@@ -0,0 +1,234 @@
+// Package config contains the operator configuration, which can be loaded from a
+// ComponentConfig style YAML file given with the `--config` flag.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/leaderelection"
+	"sigs.k8s.io/yaml"
+
+	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
+)
+
+const (
+	// APIVersion is the `apiVersion` expected in a configuration file.
+	APIVersion = "config.etcd.improbable.io/v1alpha1"
+	// Kind is the `kind` expected in a configuration file.
+	Kind = "OperatorConfig"
+)
+
+// OperatorConfig holds the operator level settings shared by the manager, the
+// reconcilers and the webhooks.
+type OperatorConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// MetricsAddr is the address the metric endpoint binds to.
+	MetricsAddr string `json:"metricsAddr,omitempty"`
+
+	// HealthProbeAddr is the address the `/healthz` and `/readyz` endpoints
+	// bind to.
+	HealthProbeAddr string `json:"healthProbeAddr,omitempty"`
+
+	// EnableLeaderElection ensures there is only one active controller
+	// manager when several are deployed.
+	EnableLeaderElection bool `json:"enableLeaderElection,omitempty"`
+
+	// LeaderElectionID is the name of the ConfigMap used as the leader
+	// election lock.
+	LeaderElectionID string `json:"leaderElectionID,omitempty"`
+
+	// LeaderElectionNamespace is the namespace of the leader election lock.
+	// When empty the namespace the operator runs in is used.
+	LeaderElectionNamespace string `json:"leaderElectionNamespace,omitempty"`
+
+	// LeaseDuration is how long replicas which are not the leader wait
+	// before taking over from a leader which has stopped renewing the lock.
+	LeaseDuration metav1.Duration `json:"leaseDuration,omitempty"`
+
+	// RenewDeadline is how long the leader keeps trying to renew the lock
+	// before giving up leadership.
+	RenewDeadline metav1.Duration `json:"renewDeadline,omitempty"`
+
+	// RetryPeriod is how long replicas wait between attempts to acquire or
+	// renew the lock.
+	RetryPeriod metav1.Duration `json:"retryPeriod,omitempty"`
+
+	// WebhookPort is the port that the webhook server listens on.
+	WebhookPort int `json:"webhookPort,omitempty"`
+
+	// EtcdImage is the image used for the etcd container of every peer.
+	EtcdImage string `json:"etcdImage,omitempty"`
+
+	// ReconcileTimeout is how long a single reconcile of a resource may
+	// take before it is abandoned.
+	ReconcileTimeout metav1.Duration `json:"reconcileTimeout,omitempty"`
+
+	// EtcdDialTimeout bounds the time taken to connect to an etcd member.
+	EtcdDialTimeout metav1.Duration `json:"etcdDialTimeout,omitempty"`
+
+	// EtcdKeepAlive is the interval between TCP keepalive probes on the
+	// connections kept open to etcd members.
+	EtcdKeepAlive metav1.Duration `json:"etcdKeepAlive,omitempty"`
+
+	// SyncPeriod is how often every EtcdPeer is reconciled even if nothing
+	// about it has changed, so that drift in the resources created for it
+	// is corrected.
+	SyncPeriod metav1.Duration `json:"syncPeriod,omitempty"`
+
+	// ClusterDomain is the DNS domain of the Kubernetes cluster, used to
+	// build the fully qualified names that peers advertise. When empty the
+	// names end in `.svc` and are resolved through the search path of the
+	// pod.
+	ClusterDomain string `json:"clusterDomain,omitempty"`
+
+	// RemoveStaleMembers has the operator remove etcd members which no
+	// longer belong to any EtcdPeer from their cluster, for peers which
+	// don't set spec.membership.removeStaleMembers. It is off by default, as
+	// a member which is wrongly removed can't rejoin.
+	RemoveStaleMembers bool `json:"removeStaleMembers,omitempty"`
+
+	// StaleMemberGracePeriod is how long a member must be seen to be stale
+	// before it is removed, for peers which don't set
+	// spec.membership.staleMemberGracePeriod.
+	StaleMemberGracePeriod metav1.Duration `json:"staleMemberGracePeriod,omitempty"`
+
+	// WatchNamespaces restricts the operator to EtcdPeers, and the resources
+	// it creates for them, in these namespaces. When empty the operator
+	// watches every namespace and needs cluster wide permissions.
+	WatchNamespaces []string `json:"watchNamespaces,omitempty"`
+
+	// PeerDefaults are applied by the defaulting webhook to new EtcdPeers
+	// which don't set them.
+	PeerDefaults etcdv1alpha1.EtcdPeerDefaults `json:"peerDefaults,omitempty"`
+}
+
+// Default returns the configuration used for any value which is not given in
+// the configuration file or on the command line.
+func Default() OperatorConfig {
+	return OperatorConfig{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: APIVersion,
+			Kind:       Kind,
+		},
+		MetricsAddr:            ":8080",
+		HealthProbeAddr:        ":8081",
+		EnableLeaderElection:   false,
+		LeaderElectionID:       "etcd-cluster-operator-leader-election",
+		LeaseDuration:          metav1.Duration{Duration: 15 * time.Second},
+		RenewDeadline:          metav1.Duration{Duration: 10 * time.Second},
+		RetryPeriod:            metav1.Duration{Duration: 2 * time.Second},
+		WebhookPort:            9443,
+		EtcdImage:              "quay.io/coreos/etcd:v3.2.27",
+		ReconcileTimeout:       metav1.Duration{Duration: 10 * time.Second},
+		SyncPeriod:             metav1.Duration{Duration: 10 * time.Hour},
+		EtcdDialTimeout:        metav1.Duration{Duration: 5 * time.Second},
+		EtcdKeepAlive:          metav1.Duration{Duration: 30 * time.Second},
+		ClusterDomain:          "cluster.local",
+		RemoveStaleMembers:     false,
+		StaleMemberGracePeriod: metav1.Duration{Duration: 5 * time.Minute},
+	}
+}
+
+// LoadConfig reads the configuration file at `path` over the top of the
+// defaults. If `path` is empty the defaults are returned. The result isn't
+// validated, as flags may still override values from the file; call Validate
+// once they have been applied. The defaults are those returned by Default.
+//
+// Fields in the file which are not known to OperatorConfig are an error, so
+// that misspelt settings are not silently ignored.
+func LoadConfig(path string) (OperatorConfig, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("unable to read configuration file: %w", err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("unable to parse configuration file %q: %w", path, err)
+	}
+
+	if cfg.APIVersion != APIVersion || cfg.Kind != Kind {
+		return cfg, fmt.Errorf("configuration file %q must have apiVersion %q and kind %q", path, APIVersion, Kind)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that the configuration can be used to run the operator.
+func (c OperatorConfig) Validate() error {
+	if c.MetricsAddr == "" {
+		return errors.New("metricsAddr must not be empty")
+	}
+	if c.HealthProbeAddr == "" {
+		return errors.New("healthProbeAddr must not be empty")
+	}
+	if c.LeaderElectionID == "" {
+		return errors.New("leaderElectionID must not be empty")
+	}
+	if c.RetryPeriod.Duration <= 0 {
+		return fmt.Errorf("retryPeriod %s must be positive", c.RetryPeriod.Duration)
+	}
+	// These are the constraints enforced by the client-go leader elector.
+	if c.LeaseDuration.Duration <= c.RenewDeadline.Duration {
+		return fmt.Errorf("leaseDuration %s must be greater than renewDeadline %s", c.LeaseDuration.Duration, c.RenewDeadline.Duration)
+	}
+	if float64(c.RenewDeadline.Duration) <= leaderelection.JitterFactor*float64(c.RetryPeriod.Duration) {
+		return fmt.Errorf("renewDeadline %s must be greater than %v times retryPeriod %s",
+			c.RenewDeadline.Duration, leaderelection.JitterFactor, c.RetryPeriod.Duration)
+	}
+	if c.WebhookPort < 1 || c.WebhookPort > 65535 {
+		return fmt.Errorf("webhookPort %d is not a valid port", c.WebhookPort)
+	}
+	if c.EtcdImage == "" {
+		return errors.New("etcdImage must not be empty")
+	}
+	if c.ReconcileTimeout.Duration <= 0 {
+		return fmt.Errorf("reconcileTimeout %s must be positive", c.ReconcileTimeout.Duration)
+	}
+	if c.SyncPeriod.Duration <= 0 {
+		return fmt.Errorf("syncPeriod %s must be positive", c.SyncPeriod.Duration)
+	}
+	if c.EtcdDialTimeout.Duration <= 0 {
+		return fmt.Errorf("etcdDialTimeout %s must be positive", c.EtcdDialTimeout.Duration)
+	}
+	if c.EtcdKeepAlive.Duration <= 0 {
+		return fmt.Errorf("etcdKeepAlive %s must be positive", c.EtcdKeepAlive.Duration)
+	}
+	if c.StaleMemberGracePeriod.Duration <= 0 {
+		return fmt.Errorf("staleMemberGracePeriod %s must be positive", c.StaleMemberGracePeriod.Duration)
+	}
+	// An empty cluster domain leaves host names unqualified.
+	if c.ClusterDomain != "" {
+		if errs := validation.IsDNS1123Subdomain(c.ClusterDomain); len(errs) > 0 {
+			return fmt.Errorf("clusterDomain %q is not a valid domain: %s", c.ClusterDomain, strings.Join(errs, ", "))
+		}
+	}
+	seen := map[string]bool{}
+	for _, namespace := range c.WatchNamespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("watchNamespaces entry %q is not a valid namespace: %s", namespace, strings.Join(errs, ", "))
+		}
+		if seen[namespace] {
+			return fmt.Errorf("watchNamespaces entry %q is repeated", namespace)
+		}
+		seen[namespace] = true
+	}
+	// Peers are only checked against the defaults once they are created, so
+	// defaults which the validating webhook would reject are caught here.
+	if errs := etcdv1alpha1.ValidatePeerDefaults(field.NewPath("peerDefaults"), c.PeerDefaults, c.EtcdImage); len(errs) > 0 {
+		return fmt.Errorf("peerDefaults would be rejected for every new EtcdPeer: %w", errs.ToAggregate())
+	}
+	return nil
+}
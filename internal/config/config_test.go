@@ -0,0 +1,234 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "etcd-operator-config")
+	require.NoError(t, err)
+	path = filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestLoadConfig_WithoutFile_ReturnsDefaults(t *testing.T) {
+	cfg, err := LoadConfig("")
+	require.NoError(t, err)
+	require.Equal(t, Default(), cfg)
+	require.Equal(t, ":8080", cfg.MetricsAddr)
+	require.False(t, cfg.EnableLeaderElection)
+	require.Equal(t, 9443, cfg.WebhookPort)
+	require.Equal(t, "quay.io/coreos/etcd:v3.2.27", cfg.EtcdImage)
+	require.Equal(t, 10*time.Second, cfg.ReconcileTimeout.Duration)
+	require.Equal(t, 10*time.Hour, cfg.SyncPeriod.Duration)
+	require.Equal(t, "cluster.local", cfg.ClusterDomain)
+	require.Equal(t, "etcd-cluster-operator-leader-election", cfg.LeaderElectionID)
+	require.Equal(t, 15*time.Second, cfg.LeaseDuration.Duration)
+	require.False(t, cfg.RemoveStaleMembers)
+	require.Equal(t, 5*time.Minute, cfg.StaleMemberGracePeriod.Duration)
+}
+
+func TestLoadConfig_WithPartialFile_KeepsOtherDefaults(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+enableLeaderElection: true
+reconcileTimeout: 30s
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.True(t, cfg.EnableLeaderElection)
+	require.Equal(t, 30*time.Second, cfg.ReconcileTimeout.Duration)
+	require.Equal(t, Default().MetricsAddr, cfg.MetricsAddr)
+	require.Equal(t, Default().EtcdImage, cfg.EtcdImage)
+}
+
+func TestLoadConfig_WithUnknownField_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+metricAddr: ":9090"
+`)
+	defer cleanup()
+
+	_, err := LoadConfig(path)
+	require.Error(t, err)
+}
+
+func TestLoadConfig_WithWrongKind_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: v1
+kind: ConfigMap
+`)
+	defer cleanup()
+
+	_, err := LoadConfig(path)
+	require.Error(t, err)
+}
+
+func TestValidate_WithInvalidValue_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+webhookPort: 0
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidate_WithInvalidClusterDomain_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+clusterDomain: .cluster.local
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidate_WithZeroStaleMemberGracePeriod_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+removeStaleMembers: true
+staleMemberGracePeriod: 0s
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidate_WithLeaseShorterThanRenewDeadline_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+leaseDuration: 5s
+renewDeadline: 10s
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidate_WithRenewDeadlineTooCloseToRetryPeriod_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+renewDeadline: 2s
+retryPeriod: 2s
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestLoadConfig_WithPeerDefaults_ParsesThem(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+peerDefaults:
+  etcd:
+    quotaBackendBytes: 4Gi
+  podTemplate:
+    priorityClassName: etcd-critical
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, "4Gi", cfg.PeerDefaults.Etcd.QuotaBackendBytes.String())
+	require.Equal(t, "etcd-critical", cfg.PeerDefaults.PodTemplate.PriorityClassName)
+}
+
+func TestLoadConfig_WithWatchNamespaces_ParsesThem(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+watchNamespaces: [team-a, team-b]
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team-a", "team-b"}, cfg.WatchNamespaces)
+}
+
+func TestValidate_WithInvalidWatchNamespace_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+watchNamespaces: [team-a, Team_B]
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestValidate_WithRepeatedWatchNamespace_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+watchNamespaces: [team-a, team-a]
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Error(t, cfg.Validate())
+}
+
+func TestLoadConfig_WithMissingFile_Fails(t *testing.T) {
+	_, err := LoadConfig(filepath.Join(os.TempDir(), "does-not-exist", "config.yaml"))
+	require.Error(t, err)
+}
+
+func TestValidate_WithDefaults_Succeeds(t *testing.T) {
+	require.NoError(t, Default().Validate())
+}
+
+func TestValidate_WithEmptyClusterDomain_Succeeds(t *testing.T) {
+	cfg := Default()
+	cfg.ClusterDomain = ""
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_WithInvalidPeerDefaults_Fails(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+apiVersion: config.etcd.improbable.io/v1alpha1
+kind: OperatorConfig
+peerDefaults:
+  etcd:
+    heartbeatInterval: 500ms
+    electionTimeout: 1s
+`)
+	defer cleanup()
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	err = cfg.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "peerDefaults.etcd.electionTimeout")
+}
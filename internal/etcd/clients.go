@@ -0,0 +1,181 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClientOptions tune the connections made to etcd members. Zero values are
+// replaced by the defaults below.
+type ClientOptions struct {
+	// DialTimeout bounds the time taken to connect to a member.
+	DialTimeout time.Duration
+	// KeepAlive is the interval between TCP keepalive probes on idle
+	// connections, which detect members that have gone away.
+	KeepAlive time.Duration
+	// RequestTimeout bounds each request made to a member.
+	RequestTimeout time.Duration
+	// IdleTimeout is how long an unused client, and its connections, are
+	// kept before being closed.
+	IdleTimeout time.Duration
+	// DialContext, if set, connects to members in place of a TCP dialer
+	// using DialTimeout and KeepAlive. Tests use it to reach fake members.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+const (
+	defaultDialTimeout    = 5 * time.Second
+	defaultKeepAlive      = 30 * time.Second
+	defaultRequestTimeout = 5 * time.Second
+	defaultIdleTimeout    = 5 * time.Minute
+)
+
+// TLSMaterial is what a client needs to talk to a member which serves clients
+// over TLS, as PEM.
+type TLSMaterial struct {
+	CertPEM    []byte
+	KeyPEM     []byte
+	CAPEM      []byte
+	ServerName string
+}
+
+// Clients hands out HTTP clients for etcd members. Clients are shared by every
+// caller using the same TLS material, so that connections to members are
+// reused from one reconcile to the next rather than opened afresh each time.
+// Clients which have not been used for the idle timeout are closed, which
+// takes care of peers being deleted and of certificates being renewed.
+type Clients struct {
+	options ClientOptions
+
+	mu      sync.Mutex
+	clients map[[sha256.Size]byte]*cachedClient
+}
+
+type cachedClient struct {
+	client    *http.Client
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+// NewClients returns an empty client cache.
+func NewClients(options ClientOptions) *Clients {
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = defaultDialTimeout
+	}
+	if options.KeepAlive <= 0 {
+		options.KeepAlive = defaultKeepAlive
+	}
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = defaultRequestTimeout
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = defaultIdleTimeout
+	}
+	return &Clients{
+		options: options,
+		clients: make(map[[sha256.Size]byte]*cachedClient),
+	}
+}
+
+// Get returns a client for members which use the given TLS material, or for
+// members which serve plain HTTP if it is nil.
+func (c *Clients) Get(material *TLSMaterial) (*http.Client, error) {
+	key := fingerprint(material)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+
+	if cached, ok := c.clients[key]; ok {
+		cached.lastUsed = now
+		return cached.client, nil
+	}
+
+	dialContext := c.options.DialContext
+	if dialContext == nil {
+		dialContext = (&net.Dialer{
+			Timeout:   c.options.DialTimeout,
+			KeepAlive: c.options.KeepAlive,
+		}).DialContext
+	}
+	transport := &http.Transport{
+		DialContext:         dialContext,
+		TLSHandshakeTimeout: c.options.DialTimeout,
+		IdleConnTimeout:     c.options.IdleTimeout,
+	}
+	if material != nil {
+		tlsConfig, err := material.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	cached := &cachedClient{
+		client:    &http.Client{Transport: transport, Timeout: c.options.RequestTimeout},
+		transport: transport,
+		lastUsed:  now,
+	}
+	c.clients[key] = cached
+	return cached.client, nil
+}
+
+// Len returns the number of cached clients.
+func (c *Clients) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.clients)
+}
+
+// expire closes the clients which haven't been used for the idle timeout. The
+// caller must hold the lock.
+func (c *Clients) expire(now time.Time) {
+	for key, cached := range c.clients {
+		if now.Sub(cached.lastUsed) > c.options.IdleTimeout {
+			cached.transport.CloseIdleConnections()
+			delete(c.clients, key)
+		}
+	}
+}
+
+func (m *TLSMaterial) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(m.CertPEM, m.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(m.CAPEM) {
+		return nil, errors.New("no valid CA certificates")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   m.ServerName,
+	}, nil
+}
+
+// fingerprint identifies TLS material, with nil standing for plain HTTP.
+func fingerprint(material *TLSMaterial) [sha256.Size]byte {
+	h := sha256.New()
+	if material != nil {
+		for _, field := range [][]byte{material.CertPEM, material.KeyPEM, material.CAPEM, []byte(material.ServerName)} {
+			// Prefix each field with its length so that moving bytes from
+			// one field to the next changes the fingerprint.
+			var length [8]byte
+			binary.LittleEndian.PutUint64(length[:], uint64(len(field)))
+			h.Write(length[:])
+			h.Write(field)
+		}
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,77 @@
+package etcd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClients_WithSameMaterial_ReusesClient(t *testing.T) {
+	clients := NewClients(ClientOptions{})
+
+	first, err := clients.Get(nil)
+	require.NoError(t, err)
+	second, err := clients.Get(nil)
+	require.NoError(t, err)
+	require.True(t, first == second)
+	require.Equal(t, 1, clients.Len())
+}
+
+func TestClients_WithUnusedClient_ExpiresIt(t *testing.T) {
+	clients := NewClients(ClientOptions{IdleTimeout: time.Millisecond})
+
+	first, err := clients.Get(nil)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	second, err := clients.Get(nil)
+	require.NoError(t, err)
+	require.False(t, first == second)
+	require.Equal(t, 1, clients.Len())
+}
+
+func TestClients_WithInvalidMaterial_Fails(t *testing.T) {
+	clients := NewClients(ClientOptions{})
+
+	_, err := clients.Get(&TLSMaterial{CertPEM: []byte("not a certificate")})
+	require.Error(t, err)
+	require.Equal(t, 0, clients.Len())
+}
+
+func TestClients_WithDifferentMaterial_UsesSeparateClients(t *testing.T) {
+	clients := NewClients(ClientOptions{})
+	certPEM, keyPEM := selfSignedCertificate(t)
+
+	first, err := clients.Get(&TLSMaterial{CertPEM: certPEM, KeyPEM: keyPEM, CAPEM: certPEM, ServerName: "bees-0"})
+	require.NoError(t, err)
+	second, err := clients.Get(&TLSMaterial{CertPEM: certPEM, KeyPEM: keyPEM, CAPEM: certPEM, ServerName: "bees-1"})
+	require.NoError(t, err)
+	require.False(t, first == second)
+	require.Equal(t, 2, clients.Len())
+}
+
+func selfSignedCertificate(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bees"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,211 @@
+// Package etcd talks to etcd members through their gRPC gateway, which serves
+// the v3 API as JSON over HTTP on the client port. This avoids depending on
+// the etcd client libraries, whose versions conflict with the Kubernetes ones.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// apiPrefixes are the prefixes under which the gateway serves the v3 API,
+// newest first. etcd v3.2 only serves `v3alpha`, v3.3 adds `v3beta` and v3.4
+// adds `v3`.
+var apiPrefixes = []string{"/v3", "/v3beta", "/v3alpha"}
+
+// MemberStatus is what an etcd member reports about itself.
+type MemberStatus struct {
+	Healthy   bool
+	MemberID  uint64
+	Leader    uint64
+	Version   string
+	DBSize    int64
+	RaftTerm  uint64
+	RaftIndex uint64
+}
+
+// Alarm is an alarm raised by a member of the cluster, such as `NOSPACE`.
+type Alarm struct {
+	MemberID uint64 `json:"memberID,string"`
+	Alarm    string `json:"alarm"`
+}
+
+// Member is a member of an etcd cluster. Members which have been added but
+// have not yet started have no name. Learners, from etcd 3.4, replicate the
+// log but don't vote.
+type Member struct {
+	ID         uint64   `json:"ID,string"`
+	Name       string   `json:"name"`
+	PeerURLs   []string `json:"peerURLs"`
+	ClientURLs []string `json:"clientURLs"`
+	IsLearner  bool     `json:"isLearner"`
+}
+
+type healthResponse struct {
+	Health string `json:"health"`
+}
+
+// statusResponse is the JSON form of the etcd StatusResponse. The gateway
+// encodes 64 bit integers as strings.
+type statusResponse struct {
+	Header struct {
+		MemberID uint64 `json:"member_id,string"`
+	} `json:"header"`
+	Version   string `json:"version"`
+	DBSize    int64  `json:"dbSize,string"`
+	Leader    uint64 `json:"leader,string"`
+	RaftIndex uint64 `json:"raftIndex,string"`
+	RaftTerm  uint64 `json:"raftTerm,string"`
+}
+
+// alarmResponse is the JSON form of the etcd AlarmResponse.
+type alarmResponse struct {
+	Alarms []Alarm `json:"alarms"`
+}
+
+// memberListResponse is the JSON form of the etcd MemberListResponse.
+type memberListResponse struct {
+	Members []Member `json:"members"`
+}
+
+// memberRemoveRequest is the JSON form of the etcd MemberRemoveRequest.
+type memberRemoveRequest struct {
+	ID uint64 `json:"ID,string"`
+}
+
+// compactionRequest is the JSON form of the etcd CompactionRequest.
+type compactionRequest struct {
+	Revision int64 `json:"revision,string"`
+	Physical bool  `json:"physical"`
+}
+
+// FetchMemberStatus asks the etcd member serving clients at `endpoint` for its
+// health and status.
+func FetchMemberStatus(ctx context.Context, httpClient *http.Client, endpoint *url.URL) (*MemberStatus, error) {
+	var health healthResponse
+	if err := doRequest(ctx, httpClient, http.MethodGet, endpoint.String()+"/health", nil, &health); err != nil {
+		return nil, fmt.Errorf("unable to query member health: %w", err)
+	}
+
+	var resp statusResponse
+	if err := callAPI(ctx, httpClient, endpoint, "/maintenance/status", struct{}{}, &resp); err != nil {
+		return nil, fmt.Errorf("unable to query member status: %w", err)
+	}
+	return &MemberStatus{
+		Healthy:   health.Health == "true",
+		MemberID:  resp.Header.MemberID,
+		Leader:    resp.Leader,
+		Version:   resp.Version,
+		DBSize:    resp.DBSize,
+		RaftTerm:  resp.RaftTerm,
+		RaftIndex: resp.RaftIndex,
+	}, nil
+}
+
+// FetchAlarms asks the etcd member serving clients at `endpoint` for the
+// alarms raised in its cluster.
+func FetchAlarms(ctx context.Context, httpClient *http.Client, endpoint *url.URL) ([]Alarm, error) {
+	var resp alarmResponse
+	if err := callAPI(ctx, httpClient, endpoint, "/maintenance/alarm", struct{}{}, &resp); err != nil {
+		return nil, fmt.Errorf("unable to query alarms: %w", err)
+	}
+	return resp.Alarms, nil
+}
+
+// ListMembers asks the etcd member serving clients at `endpoint` for the
+// members of its cluster.
+func ListMembers(ctx context.Context, httpClient *http.Client, endpoint *url.URL) ([]Member, error) {
+	var resp memberListResponse
+	if err := callAPI(ctx, httpClient, endpoint, "/cluster/member/list", struct{}{}, &resp); err != nil {
+		return nil, fmt.Errorf("unable to list members: %w", err)
+	}
+	return resp.Members, nil
+}
+
+// RemoveMember asks the etcd member serving clients at `endpoint` to remove the
+// member with ID `id` from its cluster.
+func RemoveMember(ctx context.Context, httpClient *http.Client, endpoint *url.URL, id uint64) error {
+	var resp struct{}
+	if err := callAPI(ctx, httpClient, endpoint, "/cluster/member/remove", memberRemoveRequest{ID: id}, &resp); err != nil {
+		return fmt.Errorf("unable to remove member %x: %w", id, err)
+	}
+	return nil
+}
+
+// Defragment asks the etcd member serving clients at `endpoint` to defragment
+// its backend database, releasing the space freed by compaction. The member
+// does not serve requests while it defragments.
+func Defragment(ctx context.Context, httpClient *http.Client, endpoint *url.URL) error {
+	var resp struct{}
+	if err := callAPI(ctx, httpClient, endpoint, "/maintenance/defragment", struct{}{}, &resp); err != nil {
+		return fmt.Errorf("unable to defragment member: %w", err)
+	}
+	return nil
+}
+
+// Compact asks the etcd member serving clients at `endpoint` to compact the
+// key space history of its cluster up to `revision`. The call returns once
+// every member has applied the compaction.
+func Compact(ctx context.Context, httpClient *http.Client, endpoint *url.URL, revision int64) error {
+	var resp struct{}
+	req := compactionRequest{Revision: revision, Physical: true}
+	if err := callAPI(ctx, httpClient, endpoint, "/kv/compaction", req, &resp); err != nil {
+		return fmt.Errorf("unable to compact to revision %d: %w", revision, err)
+	}
+	return nil
+}
+
+// callAPI calls a v3 API method under whichever prefix the member serves.
+func callAPI(ctx context.Context, httpClient *http.Client, endpoint *url.URL, method string, request, into interface{}) error {
+	var lastErr error
+	for _, prefix := range apiPrefixes {
+		err := doRequest(ctx, httpClient, http.MethodPost, endpoint.String()+prefix+method, request, into)
+		if errors.Is(err, errPathNotFound) {
+			lastErr = err
+			continue
+		}
+		return err
+	}
+	return lastErr
+}
+
+var errPathNotFound = errors.New("path not served by this version of etcd")
+
+func doRequest(ctx context.Context, httpClient *http.Client, method, target string, request, into interface{}) error {
+	var body []byte
+	if request != nil {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errPathNotFound
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s: %s", method, target, resp.Status, data)
+	}
+	return json.Unmarshal(data, into)
+}
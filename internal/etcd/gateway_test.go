@@ -0,0 +1,189 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEtcd serves the health and status endpoints of an etcd member which only
+// knows the given status path, as older versions of etcd do.
+func fakeEtcd(t *testing.T, health, statusPath string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"health":"` + health + `"}`))
+	})
+	mux.HandleFunc(statusPath, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		_, _ = w.Write([]byte(`{
+			"header": {"cluster_id": "14841639068965178418", "member_id": "10276657743932975437", "revision": "1", "raft_term": "2"},
+			"version": "3.2.27",
+			"dbSize": "24576",
+			"leader": "10276657743932975437",
+			"raftIndex": "42",
+			"raftTerm": "2"
+		}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestFetchMemberStatus_WithHealthyMember_ReportsStatus(t *testing.T) {
+	server := fakeEtcd(t, "true", "/v3alpha/maintenance/status")
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	status, err := FetchMemberStatus(context.Background(), server.Client(), endpoint)
+	require.NoError(t, err)
+	require.True(t, status.Healthy)
+	require.Equal(t, uint64(10276657743932975437), status.MemberID)
+	require.Equal(t, "3.2.27", status.Version)
+	require.Equal(t, int64(24576), status.DBSize)
+}
+
+func TestFetchMemberStatus_WithUnhealthyMember_ReportsUnhealthy(t *testing.T) {
+	server := fakeEtcd(t, "false", "/v3/maintenance/status")
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	status, err := FetchMemberStatus(context.Background(), server.Client(), endpoint)
+	require.NoError(t, err)
+	require.False(t, status.Healthy)
+}
+
+func TestFetchMemberStatus_WithoutStatusEndpoint_Fails(t *testing.T) {
+	server := fakeEtcd(t, "true", "/v2/unrelated")
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	_, err = FetchMemberStatus(context.Background(), server.Client(), endpoint)
+	require.Error(t, err)
+}
+
+func TestFetchMemberStatus_WithHealthyMember_ReportsRaftProgress(t *testing.T) {
+	server := fakeEtcd(t, "true", "/v3/maintenance/status")
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	status, err := FetchMemberStatus(context.Background(), server.Client(), endpoint)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10276657743932975437), status.Leader)
+	require.Equal(t, uint64(2), status.RaftTerm)
+	require.Equal(t, uint64(42), status.RaftIndex)
+}
+
+func TestFetchAlarms_WithAlarmRaised_ReportsIt(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3beta/maintenance/alarm", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		_, _ = w.Write([]byte(`{
+			"header": {"cluster_id": "14841639068965178418", "member_id": "10276657743932975437"},
+			"alarms": [{"memberID": "10276657743932975437", "alarm": "NOSPACE"}]
+		}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	alarms, err := FetchAlarms(context.Background(), server.Client(), endpoint)
+	require.NoError(t, err)
+	require.Equal(t, []Alarm{{MemberID: 10276657743932975437, Alarm: "NOSPACE"}}, alarms)
+}
+
+func TestDefragment_WithMember_CallsDefragment(t *testing.T) {
+	called := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/maintenance/defragment", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		called = true
+		_, _ = w.Write([]byte(`{"header": {"member_id": "10276657743932975437"}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, Defragment(context.Background(), server.Client(), endpoint))
+	require.True(t, called)
+}
+
+func TestCompact_WithRevision_RequestsPhysicalCompaction(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3alpha/kv/compaction", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, map[string]interface{}{"revision": "42", "physical": true}, req)
+		_, _ = w.Write([]byte(`{"header": {"revision": "50"}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, Compact(context.Background(), server.Client(), endpoint, 42))
+}
+
+func TestCompact_WithCompactedRevision_Fails(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/compaction", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "etcdserver: mvcc: required revision has been compacted", "code": 11}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	err = Compact(context.Background(), server.Client(), endpoint, 42)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "required revision has been compacted")
+}
+
+func TestListMembers_WithCluster_ReportsMembers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/cluster/member/list", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{
+			"header": {"member_id": "10276657743932975437"},
+			"members": [
+				{"ID": "10276657743932975437", "name": "bees-0", "peerURLs": ["http://bees-0.bees:2380"], "clientURLs": ["http://bees-0.bees:2379"]},
+				{"ID": "9372538179322589801", "peerURLs": ["http://bees-1.bees:2380"], "isLearner": true}
+			]
+		}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	members, err := ListMembers(context.Background(), server.Client(), endpoint)
+	require.NoError(t, err)
+	require.Equal(t, []Member{
+		{ID: 10276657743932975437, Name: "bees-0", PeerURLs: []string{"http://bees-0.bees:2380"}, ClientURLs: []string{"http://bees-0.bees:2379"}},
+		{ID: 9372538179322589801, PeerURLs: []string{"http://bees-1.bees:2380"}, IsLearner: true},
+	}, members)
+}
+
+func TestRemoveMember_WithID_SendsIt(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/cluster/member/remove", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, map[string]interface{}{"ID": "9372538179322589801"}, req)
+		_, _ = w.Write([]byte(`{"header": {}, "members": []}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, RemoveMember(context.Background(), server.Client(), endpoint, 9372538179322589801))
+}
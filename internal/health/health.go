@@ -0,0 +1,173 @@
+// Package health serves the liveness and readiness endpoints of the operator,
+// `/healthz` and `/readyz`, for use by Kubernetes probes.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check returns an error when the part of the operator it checks is not
+// healthy or not ready.
+type Check func() error
+
+// Server serves the results of the registered checks. `/healthz` fails when
+// any liveness check fails, and `/readyz` when any readiness check fails. Add
+// `?verbose` to see the result of each check.
+type Server struct {
+	// Addr is the address the server listens on.
+	Addr string
+
+	mu        sync.Mutex
+	liveness  map[string]Check
+	readiness map[string]Check
+}
+
+// AddLivenessCheck registers a check which fails `/healthz`.
+func (s *Server) AddLivenessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.liveness == nil {
+		s.liveness = make(map[string]Check)
+	}
+	s.liveness[name] = check
+}
+
+// AddReadinessCheck registers a check which fails `/readyz`.
+func (s *Server) AddReadinessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readiness == nil {
+		s.readiness = make(map[string]Check)
+	}
+	s.readiness[name] = check
+}
+
+// Handler returns the handler for both endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.serveChecks(w, r, s.liveness)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.serveChecks(w, r, s.readiness)
+	})
+	return mux
+}
+
+// Start serves the endpoints until `stop` is closed.
+func (s *Server) Start(stop <-chan struct{}) error {
+	server := &http.Server{Addr: s.Addr, Handler: s.Handler()}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(ctx)
+	}
+}
+
+func (s *Server) serveChecks(w http.ResponseWriter, r *http.Request, checks map[string]Check) {
+	s.mu.Lock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ordered := make([]Check, len(names))
+	for i, name := range names {
+		ordered[i] = checks[name]
+	}
+	s.mu.Unlock()
+
+	var report strings.Builder
+	failed := false
+	for i, check := range ordered {
+		if err := check(); err != nil {
+			failed = true
+			fmt.Fprintf(&report, "[-]%s failed: %s\n", names[i], err)
+		} else {
+			fmt.Fprintf(&report, "[+]%s ok\n", names[i])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if failed {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, report.String())
+		return
+	}
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		fmt.Fprint(w, report.String())
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// Flag is a Check which fails until Set is called. It is used for conditions
+// that hold once reached, such as the informer caches having synced.
+type Flag struct {
+	mu     sync.Mutex
+	set    bool
+	reason string
+}
+
+// NewFlag returns an unset flag, whose check fails with `reason`.
+func NewFlag(reason string) *Flag {
+	return &Flag{reason: reason}
+}
+
+// Set makes the flag's check pass.
+func (f *Flag) Set() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set = true
+}
+
+// Check passes once the flag has been set.
+func (f *Flag) Check() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.set {
+		return errors.New(f.reason)
+	}
+	return nil
+}
+
+// Start sets the flag and waits for `stop`. Adding the flag to a manager as a
+// Runnable therefore sets it once the manager has synced its caches, which
+// it does before starting any Runnable.
+func (f *Flag) Start(stop <-chan struct{}) error {
+	f.Set()
+	<-stop
+	return nil
+}
+
+// NeedLeaderElection is false so that the flag is set on every replica, not
+// only the leader.
+func (f *Flag) NeedLeaderElection() bool {
+	return false
+}
+
+// DialCheck returns a check which passes when something is listening on
+// `addr`.
+func DialCheck(addr string) Check {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
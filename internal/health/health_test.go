@@ -0,0 +1,62 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, s *Server, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestServer_WithPassingChecks_ReportsOK(t *testing.T) {
+	var s Server
+	s.AddLivenessCheck("ping", func() error { return nil })
+
+	code, body := get(t, &s, "/healthz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", body)
+
+	code, body = get(t, &s, "/healthz?verbose")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "[+]ping ok\nok", body)
+}
+
+func TestServer_WithFailingReadinessCheck_FailsOnlyReadyz(t *testing.T) {
+	var s Server
+	s.AddLivenessCheck("ping", func() error { return nil })
+	s.AddReadinessCheck("webhook", func() error { return errors.New("connection refused") })
+	s.AddReadinessCheck("informers", func() error { return nil })
+
+	code, _ := get(t, &s, "/healthz")
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := get(t, &s, "/readyz")
+	require.Equal(t, http.StatusInternalServerError, code)
+	require.Equal(t, "[+]informers ok\n[-]webhook failed: connection refused\n", body)
+}
+
+func TestFlag_OnceStarted_Passes(t *testing.T) {
+	flag := NewFlag("not synced")
+	require.EqualError(t, flag.Check(), "not synced")
+
+	stop := make(chan struct{})
+	close(stop)
+	require.NoError(t, flag.Start(stop))
+	require.NoError(t, flag.Check())
+}
+
+func TestDialCheck_WithListener_Passes(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	addr := server.Listener.Addr().String()
+
+	require.NoError(t, DialCheck(addr)())
+	server.Close()
+	require.Error(t, DialCheck(addr)())
+}
@@ -0,0 +1,144 @@
+// Package logging configures the operator's logger from command line flags.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	ctrlzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+const (
+	// EncoderConsole writes human readable lines.
+	EncoderConsole = "console"
+	// EncoderJSON writes a JSON object per line.
+	EncoderJSON = "json"
+)
+
+// Options are the logging settings. The defaults match the development logger
+// which the operator has always used.
+type Options struct {
+	// Level is the minimum level of messages which are logged. It can be
+	// changed while the operator runs.
+	Level zap.AtomicLevel
+	// StacktraceLevel is the level at and above which stacktraces are
+	// logged.
+	StacktraceLevel zap.AtomicLevel
+	// Encoder is either EncoderConsole or EncoderJSON.
+	Encoder string
+}
+
+// BindFlags registers the logging flags on `fs`, and returns the options they
+// set.
+func BindFlags(fs *flag.FlagSet) *Options {
+	o := &Options{
+		Level:           zap.NewAtomicLevelAt(zap.DebugLevel),
+		StacktraceLevel: zap.NewAtomicLevelAt(zap.WarnLevel),
+		Encoder:         EncoderConsole,
+	}
+	fs.Var(levelFlag{o.Level}, "log-level",
+		"The minimum level of messages to log: error, warn, info, debug, or a number N to include V(N) messages.")
+	fs.Var(levelFlag{o.StacktraceLevel}, "log-stacktrace-level",
+		"The level at and above which stacktraces are logged: error, warn, info or debug.")
+	fs.Var(encoderFlag{&o.Encoder}, "log-encoder",
+		"The log format: console or json.")
+	return o
+}
+
+// Logger builds a logger from the options.
+func (o *Options) Logger() logr.Logger {
+	encoderConfig := zap.NewDevelopmentEncoderConfig()
+	encoder := zapcore.NewConsoleEncoder(encoderConfig)
+	if o.Encoder == EncoderJSON {
+		encoderConfig = zap.NewProductionEncoderConfig()
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
+	return ctrlzap.New(func(zo *ctrlzap.Options) {
+		zo.Development = true
+		zo.Encoder = encoder
+		zo.Level = &o.Level
+		zo.StacktraceLevel = &o.StacktraceLevel
+	})
+}
+
+// WatchSignals lets the verbosity be changed without restarting the operator:
+// SIGUSR1 logs one more V level, and SIGUSR2 one fewer.
+func (o *Options) WatchSignals(log logr.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			level := o.Level.Level()
+			if sig == syscall.SIGUSR1 {
+				level--
+			} else {
+				level++
+			}
+			if level < minLevel || level > zapcore.FatalLevel {
+				continue
+			}
+			o.Level.SetLevel(level)
+			log.Info("Changed log level", "level", level.String())
+		}
+	}()
+}
+
+// minLevel is the most verbose level which can be set, giving V(10) messages.
+const minLevel = zapcore.Level(-10)
+
+// levelFlag parses a zap level name, or a logr verbosity. logr's V(N) is
+// logged by zap at level -N.
+type levelFlag struct {
+	level zap.AtomicLevel
+}
+
+func (f levelFlag) Set(value string) error {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 0 || zapcore.Level(-n) < minLevel {
+			return fmt.Errorf("verbosity must be between 0 and %d", -minLevel)
+		}
+		f.level.SetLevel(zapcore.Level(-n))
+		return nil
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return err
+	}
+	f.level.SetLevel(level)
+	return nil
+}
+
+func (f levelFlag) String() string {
+	// flag.isZeroValue calls String on a zero levelFlag.
+	if f.level == (zap.AtomicLevel{}) {
+		return ""
+	}
+	return f.level.Level().String()
+}
+
+type encoderFlag struct {
+	encoder *string
+}
+
+func (f encoderFlag) Set(value string) error {
+	switch value {
+	case EncoderConsole, EncoderJSON:
+		*f.encoder = value
+		return nil
+	}
+	return fmt.Errorf("unknown encoder %q, must be %s or %s", value, EncoderConsole, EncoderJSON)
+}
+
+func (f encoderFlag) String() string {
+	if f.encoder == nil {
+		return ""
+	}
+	return *f.encoder
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func parse(t *testing.T, args ...string) (*Options, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := BindFlags(fs)
+	return o, fs.Parse(args)
+}
+
+func TestBindFlags_WithoutFlags_UsesDevelopmentDefaults(t *testing.T) {
+	o, err := parse(t)
+	require.NoError(t, err)
+	require.Equal(t, zapcore.DebugLevel, o.Level.Level())
+	require.Equal(t, zapcore.WarnLevel, o.StacktraceLevel.Level())
+	require.Equal(t, EncoderConsole, o.Encoder)
+}
+
+func TestBindFlags_WithVerbosity_EnablesVLevels(t *testing.T) {
+	o, err := parse(t, "--log-level=2", "--log-encoder=json", "--log-stacktrace-level=error")
+	require.NoError(t, err)
+	require.True(t, o.Level.Enabled(zapcore.Level(-2)))
+	require.False(t, o.Level.Enabled(zapcore.Level(-3)))
+	require.Equal(t, zapcore.ErrorLevel, o.StacktraceLevel.Level())
+	require.Equal(t, EncoderJSON, o.Encoder)
+}
+
+func TestBindFlags_WithInvalidValues_Fails(t *testing.T) {
+	for _, args := range [][]string{
+		{"--log-level=loud"},
+		{"--log-level=-1"},
+		{"--log-level=11"},
+		{"--log-encoder=yaml"},
+	} {
+		_, err := parse(t, args...)
+		require.Error(t, err, "%v", args)
+	}
+}
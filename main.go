@@ -2,15 +2,23 @@ package main
 
 import (
 	"flag"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	etcdv1alpha1 "github.com/improbable-eng/etcd-cluster-operator/api/v1alpha1"
 	"github.com/improbable-eng/etcd-cluster-operator/controllers"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/config"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/etcd"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/health"
+	"github.com/improbable-eng/etcd-cluster-operator/internal/logging"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -27,37 +35,208 @@ func init() {
 }
 
 func main() {
+	var configFile string
 	var metricsAddr string
+	var healthProbeAddr string
 	var enableLeaderElection bool
-	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
+	var leaderElectionID, leaderElectionNamespace string
+	var leaseDuration, renewDeadline, retryPeriod time.Duration
+	var reconcileTimeout, syncPeriod time.Duration
+	var etcdDialTimeout, etcdKeepAlive time.Duration
+	var clusterDomain string
+	var removeStaleMembers bool
+	var staleMemberGracePeriod time.Duration
+	var watchNamespaces string
+	defaults := config.Default()
+	flag.StringVar(&configFile, "config", "",
+		"The operator configuration file. Flags given on the command line override values from the file.")
+	flag.StringVar(&metricsAddr, "metrics-addr", defaults.MetricsAddr, "The address the metric endpoint binds to.")
+	flag.StringVar(&healthProbeAddr, "health-probe-addr", defaults.HealthProbeAddr,
+		"The address the /healthz and /readyz endpoints bind to.")
+	flag.BoolVar(&enableLeaderElection, "enable-leader-election", defaults.EnableLeaderElection,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&leaderElectionID, "leader-election-id", defaults.LeaderElectionID,
+		"The name of the ConfigMap used as the leader election lock.")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", defaults.LeaderElectionNamespace,
+		"The namespace of the leader election lock. Defaults to the namespace the operator runs in.")
+	flag.DurationVar(&leaseDuration, "leader-election-lease-duration", defaults.LeaseDuration.Duration,
+		"How long replicas wait before taking over from a leader which has stopped renewing the lock.")
+	flag.DurationVar(&renewDeadline, "leader-election-renew-deadline", defaults.RenewDeadline.Duration,
+		"How long the leader keeps trying to renew the lock before giving up leadership.")
+	flag.DurationVar(&retryPeriod, "leader-election-retry-period", defaults.RetryPeriod.Duration,
+		"How long replicas wait between attempts to acquire or renew the lock.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", defaults.ReconcileTimeout.Duration,
+		"How long a single reconcile of an EtcdPeer may take before it is abandoned.")
+	flag.DurationVar(&syncPeriod, "sync-period", defaults.SyncPeriod.Duration,
+		"How often every EtcdPeer is reconciled even if nothing has changed, to correct drift.")
+	flag.DurationVar(&etcdDialTimeout, "etcd-dial-timeout", defaults.EtcdDialTimeout.Duration,
+		"How long to wait when connecting to an etcd member.")
+	flag.DurationVar(&etcdKeepAlive, "etcd-keepalive", defaults.EtcdKeepAlive.Duration,
+		"The interval between TCP keepalive probes on connections to etcd members.")
+	flag.StringVar(&clusterDomain, "cluster-domain", defaults.ClusterDomain,
+		"The DNS domain of the Kubernetes cluster, used in the URLs that etcd peers advertise. Leave empty to advertise names ending in .svc.")
+	flag.BoolVar(&removeStaleMembers, "remove-stale-members", defaults.RemoveStaleMembers,
+		"Remove etcd members which no longer belong to any EtcdPeer from their cluster, unless the EtcdPeer's spec.membership says otherwise.")
+	flag.DurationVar(&staleMemberGracePeriod, "stale-member-grace-period", defaults.StaleMemberGracePeriod.Duration,
+		"How long a member must be seen to be stale before it is removed.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", strings.Join(defaults.WatchNamespaces, ","),
+		"Comma separated namespaces to restrict the operator to. Defaults to all namespaces.")
+	logOptions := logging.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	ctrl.SetLogger(zap.Logger(true))
+	ctrl.SetLogger(logOptions.Logger())
+	logOptions.WatchSignals(setupLog)
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		LeaderElection:     enableLeaderElection,
-		Port:               9443,
+	operatorConfig, err := config.LoadConfig(configFile)
+	if err != nil {
+		setupLog.Error(err, "unable to load operator configuration")
+		os.Exit(1)
+	}
+
+	// Only flags which were explicitly given override the configuration file.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "metrics-addr":
+			operatorConfig.MetricsAddr = metricsAddr
+		case "health-probe-addr":
+			operatorConfig.HealthProbeAddr = healthProbeAddr
+		case "enable-leader-election":
+			operatorConfig.EnableLeaderElection = enableLeaderElection
+		case "leader-election-id":
+			operatorConfig.LeaderElectionID = leaderElectionID
+		case "leader-election-namespace":
+			operatorConfig.LeaderElectionNamespace = leaderElectionNamespace
+		case "leader-election-lease-duration":
+			operatorConfig.LeaseDuration.Duration = leaseDuration
+		case "leader-election-renew-deadline":
+			operatorConfig.RenewDeadline.Duration = renewDeadline
+		case "leader-election-retry-period":
+			operatorConfig.RetryPeriod.Duration = retryPeriod
+		case "reconcile-timeout":
+			operatorConfig.ReconcileTimeout.Duration = reconcileTimeout
+		case "sync-period":
+			operatorConfig.SyncPeriod.Duration = syncPeriod
+		case "etcd-dial-timeout":
+			operatorConfig.EtcdDialTimeout.Duration = etcdDialTimeout
+		case "etcd-keepalive":
+			operatorConfig.EtcdKeepAlive.Duration = etcdKeepAlive
+		case "cluster-domain":
+			operatorConfig.ClusterDomain = clusterDomain
+		case "remove-stale-members":
+			operatorConfig.RemoveStaleMembers = removeStaleMembers
+		case "stale-member-grace-period":
+			operatorConfig.StaleMemberGracePeriod.Duration = staleMemberGracePeriod
+		case "watch-namespaces":
+			operatorConfig.WatchNamespaces = nil
+			for _, namespace := range strings.Split(watchNamespaces, ",") {
+				if namespace = strings.TrimSpace(namespace); namespace != "" {
+					operatorConfig.WatchNamespaces = append(operatorConfig.WatchNamespaces, namespace)
+				}
+			}
+		}
 	})
+	// The file and the flags are only validated together, so that a flag can
+	// correct a value from the file.
+	if err := operatorConfig.Validate(); err != nil {
+		setupLog.Error(err, "invalid operator configuration")
+		os.Exit(1)
+	}
+
+	options := ctrl.Options{
+		Scheme:             scheme,
+		MetricsBindAddress: operatorConfig.MetricsAddr,
+		LeaderElection:     operatorConfig.EnableLeaderElection,
+		Port:               operatorConfig.WebhookPort,
+		SyncPeriod:         &operatorConfig.SyncPeriod.Duration,
+
+		LeaderElectionID:        operatorConfig.LeaderElectionID,
+		LeaderElectionNamespace: operatorConfig.LeaderElectionNamespace,
+		LeaseDuration:           &operatorConfig.LeaseDuration.Duration,
+		RenewDeadline:           &operatorConfig.RenewDeadline.Duration,
+		RetryPeriod:             &operatorConfig.RetryPeriod.Duration,
+	}
+	if namespaces := operatorConfig.WatchNamespaces; len(namespaces) > 0 {
+		setupLog.Info("restricting the operator to namespaces", "namespaces", namespaces)
+		if len(namespaces) == 1 {
+			options.Namespace = namespaces[0]
+		} else {
+			options.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+		}
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
 	if err = (&controllers.EtcdPeerReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("EtcdPeer"),
+		Client:    mgr.GetClient(),
+		Log:       ctrl.Log.WithName("controllers").WithName("EtcdPeer"),
+		APIReader: mgr.GetAPIReader(),
+
+		EtcdImage:        operatorConfig.EtcdImage,
+		ReconcileTimeout: operatorConfig.ReconcileTimeout.Duration,
+		ClusterDomain:    operatorConfig.ClusterDomain,
+		Recorder:         mgr.GetEventRecorderFor("etcdpeer-controller"),
+		EtcdClients: etcd.NewClients(etcd.ClientOptions{
+			DialTimeout: operatorConfig.EtcdDialTimeout.Duration,
+			KeepAlive:   operatorConfig.EtcdKeepAlive.Duration,
+		}),
+		RemoveStaleMembers:     operatorConfig.RemoveStaleMembers,
+		StaleMemberGracePeriod: operatorConfig.StaleMemberGracePeriod.Duration,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "EtcdPeer")
 		os.Exit(1)
 	}
+	if err = (&controllers.EtcdProxyReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("EtcdProxy"),
+
+		EtcdImage:        operatorConfig.EtcdImage,
+		ReconcileTimeout: operatorConfig.ReconcileTimeout.Duration,
+		ClusterDomain:    operatorConfig.ClusterDomain,
+		Recorder:         mgr.GetEventRecorderFor("etcdproxy-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "EtcdProxy")
+		os.Exit(1)
+	}
+	healthServer := &health.Server{Addr: operatorConfig.HealthProbeAddr}
+	healthServer.AddLivenessCheck("ping", func() error { return nil })
+	cacheSynced := health.NewFlag("informer caches have not synced")
+	if err := mgr.Add(cacheSynced); err != nil {
+		setupLog.Error(err, "unable to add cache sync check")
+		os.Exit(1)
+	}
+	healthServer.AddReadinessCheck("informers", cacheSynced.Check)
+
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		healthServer.AddReadinessCheck("webhook",
+			health.DialCheck(net.JoinHostPort("localhost", strconv.Itoa(operatorConfig.WebhookPort))))
+		etcdv1alpha1.SetPeerDefaults(operatorConfig.PeerDefaults)
+		etcdv1alpha1.SetEtcdImage(operatorConfig.EtcdImage)
+		if err = (&etcdv1alpha1.EtcdPeer{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "EtcdPeer")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	if err := controllers.RegisterMetrics(mgr.GetClient()); err != nil {
+		setupLog.Error(err, "unable to register metrics")
+		os.Exit(1)
+	}
+
+	stop := ctrl.SetupSignalHandler()
+	go func() {
+		if err := healthServer.Start(stop); err != nil {
+			setupLog.Error(err, "problem running health probe server")
+			os.Exit(1)
+		}
+	}()
+
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(stop); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}